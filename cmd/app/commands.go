@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync_dir/internal/plan"
+	"sync_dir/internal/restore"
+	"sync_dir/internal/scanner"
+	"sync_dir/internal/scanner/generated_scanner"
+	"sync_dir/internal/storage"
+	"sync_dir/internal/versions"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	exitOK = iota
+	// exitFailed means the command ran but some files are not in sync.
+	exitFailed
+	// exitUsage means wrong flags or arguments.
+	exitUsage
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(ctx context.Context, c *config, args []string) (int, error)
+	// jobs says how the command runs the jobs of a config file.
+	jobs jobsMode
+	// scans means the command reads sourceDir, so it must not overlap
+	// destDir.
+	scans bool
+}
+
+type jobsMode int
+
+const (
+	// oneJob commands need -job if the config file has several jobs.
+	oneJob jobsMode = iota
+	// eachJob commands run the jobs one after another.
+	eachJob
+	// allJobs commands run the jobs at once.
+	allJobs
+)
+
+var commands = []command{
+	{name: "sync", usage: "run one sync pass and exit", run: runSync, jobs: eachJob, scans: true},
+	{name: "watch", usage: "keep syncing until interrupted", run: runWatch, jobs: allJobs, scans: true},
+	{name: "status", usage: "show files in the index", run: runStatus},
+	{name: "diff", usage: "compare source and destination directories", run: runDiff, scans: true},
+	{name: "verify", usage: "re-hash destination files against the index", run: runVerify, scans: true},
+	{name: "failed", usage: "show files waiting for a retry and given up files", run: runFailed},
+	{name: "retry", usage: "retry failed files now: retry [file...]", run: runRetry, scans: true},
+	{name: "apply", usage: "apply a plan saved with -planFile to its directories: apply <plan file>", run: runApply},
+	{name: "restore", usage: "list or restore previous versions: restore [-version time | -at time] [-to dir] <path>", run: runRestore},
+}
+
+func runSync(ctx context.Context, c *config, args []string) (int, error) {
+	fileStorage, err := c.openStorage(c.dryRun)
+	if err != nil {
+		return exitFailed, err
+	}
+	defer c.closeStorage(fileStorage)
+	dirScanner := c.newScanner(ctx, fileStorage)
+	if c.dryRun {
+		if _, err = printPlan(c, dirScanner); err != nil {
+			return exitFailed, err
+		}
+		return exitOK, nil
+	}
+	wrappedScanner := generated_scanner.NewFileScannerWithLogrus(dirScanner, c.logger)
+	if err = wrappedScanner.SyncOnce(); err != nil {
+		return exitFailed, err
+	}
+	return exitOK, nil
+}
+
+func runWatch(ctx context.Context, c *config, args []string) (int, error) {
+	fileStorage, err := c.openStorage(false)
+	if err != nil {
+		return exitFailed, err
+	}
+	defer c.closeStorage(fileStorage)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	wrappedScanner := generated_scanner.NewFileScannerWithLogrus(c.newScanner(ctx, fileStorage), c.logger)
+	if err = c.serveControl(ctx, wrappedScanner, fileStorage, cancel); err != nil {
+		return exitFailed, err
+	}
+	wrappedScanner.Run()
+	wrappedScanner.Wait()
+	return exitOK, nil
+}
+
+func runStatus(ctx context.Context, c *config, args []string) (int, error) {
+	fileStorage, err := storage.ReadFileStorage(c.indexDir, c.logger)
+	if err != nil {
+		return exitFailed, fmt.Errorf("error loading index: %v", err)
+	}
+	counts := map[storage.Status]int{}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "STATUS\tFILE\tMODIFIED\tATTEMPTS\tERROR\n")
+	for _, file := range fileStorage.List() {
+		counts[file.Status]++
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\n", file.Status, file.FileName, file.LastModified.Format(time.RFC3339), file.Attempts, file.LastError)
+	}
+	if err = tw.Flush(); err != nil {
+		return exitFailed, err
+	}
+	fmt.Printf("%v synced, %v queued, %v failed, %v given up\n",
+		counts[storage.Sync], counts[storage.InSync], counts[storage.Failed], counts[storage.Abandoned])
+	if counts[storage.Failed] > 0 || counts[storage.Abandoned] > 0 {
+		return exitFailed, nil
+	}
+	return exitOK, nil
+}
+
+func runFailed(ctx context.Context, c *config, args []string) (int, error) {
+	fileStorage, err := storage.ReadFileStorage(c.indexDir, c.logger)
+	if err != nil {
+		return exitFailed, fmt.Errorf("error loading index: %v", err)
+	}
+	failed := fileStorage.Failed()
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "STATUS\tFILE\tATTEMPTS\tNEXT RETRY\tERROR\n")
+	for _, file := range failed {
+		nextRetry := "-"
+		if file.Status == storage.Failed {
+			nextRetry = file.NextRetry.Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\n", file.Status, file.FileName, file.Attempts, nextRetry, file.LastError)
+	}
+	if err = tw.Flush(); err != nil {
+		return exitFailed, err
+	}
+	fmt.Printf("%v files failed\n", len(failed))
+	if len(failed) > 0 {
+		return exitFailed, nil
+	}
+	return exitOK, nil
+}
+
+// runRetry resets the attempt counters of the given failed files, or of all
+// of them, and retries them right away.
+func runRetry(ctx context.Context, c *config, args []string) (int, error) {
+	fileStorage, err := c.openStorage(false)
+	if err != nil {
+		return exitFailed, err
+	}
+	defer c.closeStorage(fileStorage)
+	reset := fileStorage.ResetFailed(args...)
+	fmt.Printf("Retrying %v files\n", reset)
+	if err = c.newScanner(ctx, fileStorage).RetryFailed(); err != nil {
+		return exitFailed, err
+	}
+	return exitOK, nil
+}
+
+// runDiff compares the directories themselves, ignoring the index: files
+// missing or different in the destination are listed as copies and updates,
+// files found only in the destination as deletions. Like diff(1) it exits
+// with exitFailed if the directories differ.
+func runDiff(ctx context.Context, c *config, args []string) (int, error) {
+	c.reconcile, c.removeExtra = true, true
+	dirScanner := c.newScanner(ctx, storage.NewFileStorage(map[string]storage.FilesInfo{}, c.logger).WithHasher(c.hasher))
+	p, err := printPlan(c, dirScanner)
+	if err != nil {
+		return exitFailed, err
+	}
+	if len(p.Items) > 0 {
+		return exitFailed, nil
+	}
+	return exitOK, nil
+}
+
+// runVerify checks destination files against the index. With -repair the
+// index is opened for writing and the problems found are fixed.
+func runVerify(ctx context.Context, c *config, args []string) (int, error) {
+	fileStorage, err := c.openStorage(!c.repair)
+	if err != nil {
+		return exitFailed, err
+	}
+	defer c.closeStorage(fileStorage)
+	wrappedScanner := generated_scanner.NewFileScannerWithLogrus(c.newScanner(ctx, fileStorage), c.logger)
+	drifts, err := wrappedScanner.Verify(c.repair)
+	if err != nil {
+		return exitFailed, err
+	}
+	unrepaired := 0
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "PROBLEM\tFILE\tREPAIRED\tERROR\n")
+	for _, drift := range drifts {
+		if !drift.Repaired {
+			unrepaired++
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", drift.Kind, drift.FileName, drift.Repaired, drift.Err)
+	}
+	if err = tw.Flush(); err != nil {
+		return exitFailed, err
+	}
+	fmt.Printf("%v files differ from the index, %v repaired\n", len(drifts), len(drifts)-unrepaired)
+	if unrepaired > 0 {
+		return exitFailed, nil
+	}
+	return exitOK, nil
+}
+
+func runApply(ctx context.Context, c *config, args []string) (int, error) {
+	if len(args) != 1 {
+		return exitUsage, fmt.Errorf("usage: %v apply [flags] <plan file>", os.Args[0])
+	}
+	p, err := plan.Load(args[0])
+	if err != nil {
+		return exitFailed, err
+	}
+	fileStorage, err := c.openStorage(false)
+	if err != nil {
+		return exitFailed, err
+	}
+	defer c.closeStorage(fileStorage)
+	if err = c.newScanner(ctx, fileStorage).Apply(p); err != nil {
+		return exitFailed, err
+	}
+	return exitOK, nil
+}
+
+// runRestore lists the versions of the files under a path. With -version
+// it restores the version of that time, with -at every file as it was then.
+func runRestore(ctx context.Context, c *config, args []string) (int, error) {
+	if len(args) != 1 || c.restoreVersion != "" && c.restoreAt != "" {
+		return exitUsage, fmt.Errorf("usage: %v restore [-version time | -at time] [-to dir] <path>", os.Args[0])
+	}
+	path := args[0]
+	fileStorage, err := c.openStorage(true)
+	if err != nil {
+		return exitFailed, err
+	}
+	restorer := restore.New(c.destDir, versions.NewStore(c.destDir, versions.Policy{}), fileStorage, c.preserved)
+	var entries []restore.Entry
+	switch {
+	case c.restoreAt != "":
+		at, err := time.Parse(time.RFC3339, c.restoreAt)
+		if err != nil {
+			return exitUsage, err
+		}
+		if entries, err = restorer.At(path, at); err != nil {
+			return exitFailed, err
+		}
+	case c.restoreVersion != "":
+		at, err := time.Parse(time.RFC3339Nano, c.restoreVersion)
+		if err != nil {
+			return exitUsage, err
+		}
+		listed, err := restorer.List(path)
+		if err != nil {
+			return exitFailed, err
+		}
+		for _, entry := range listed {
+			if entry.Time.Equal(at) {
+				entries = append(entries, entry)
+			}
+		}
+	default:
+		return listVersions(restorer, path)
+	}
+	if c.restoreTo == "" {
+		return exitUsage, fmt.Errorf("restore needs -to, the directory to restore files to")
+	}
+	if len(entries) == 0 {
+		return exitFailed, fmt.Errorf("no versions of %v to restore", path)
+	}
+	if filepath.Clean(c.restoreTo) == filepath.Clean(c.destDir) {
+		fmt.Fprintf(os.Stderr, "Warning: restoring into destination directory %v, the index is not updated: "+
+			"the files differ from %v until they change there, and verify reports them\n", c.destDir, c.sourceDir)
+	}
+	for _, entry := range entries {
+		if err = restorer.Restore(entry, c.restoreTo); err != nil {
+			return exitFailed, err
+		}
+		c.logger.Infof("Restored %v from %v", entry.FileName, entry.Path)
+	}
+	fmt.Printf("Restored %v files to %v\n", len(entries), c.restoreTo)
+	return exitOK, nil
+}
+
+func listVersions(restorer *restore.Restorer, path string) (int, error) {
+	entries, err := restorer.List(path)
+	if err != nil {
+		return exitFailed, err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "FILE\tVERSION\tMODIFIED\tSIZE\n")
+	for _, entry := range entries {
+		version := "current"
+		if !entry.Current() {
+			version = entry.Time.Format(time.RFC3339Nano)
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", entry.FileName, version, entry.Modified.Format(time.RFC3339), entry.Size)
+	}
+	if err = tw.Flush(); err != nil {
+		return exitFailed, err
+	}
+	if len(entries) == 0 {
+		return exitFailed, fmt.Errorf("no versions of %v", path)
+	}
+	return exitOK, nil
+}
+
+func printPlan(c *config, dirScanner *scanner.DirScanner) (*plan.Plan, error) {
+	p, err := dirScanner.Plan()
+	if err != nil {
+		return nil, err
+	}
+	if c.planFile != "" {
+		if err = p.Save(c.planFile); err != nil {
+			return nil, err
+		}
+	}
+	if c.job != "" && c.planFormat == "table" {
+		fmt.Printf("Job %v:\n", c.job)
+	}
+	if c.planFormat == "json" {
+		err = p.WriteJSON(os.Stdout)
+	} else {
+		err = p.WriteTable(os.Stdout)
+	}
+	return p, err
+}
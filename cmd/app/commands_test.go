@@ -0,0 +1,294 @@
+package main
+
+import (
+	"github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"sync_dir/internal/storage"
+	"sync_dir/internal/versions"
+	"testing"
+	"time"
+)
+
+// testDirs are the directories of a command test.
+type testDirs struct {
+	src, dst, tmp string
+}
+
+// args returns the arguments running cmd on the test directories, with the
+// flags and arguments in extra.
+func (d testDirs) args(cmd string, extra ...string) []string {
+	args := []string{cmd, "-sourceDir", d.src, "-destDir", d.dst, "-logPath", filepath.Join(d.tmp, "log.txt")}
+	return append(args, extra...)
+}
+
+func (d testDirs) mustRun(t *testing.T, cmd string, extra ...string) {
+	if code := run(d.args(cmd, extra...)); code != exitOK {
+		t.Fatalf("%v %v exit code = %v", cmd, extra, code)
+	}
+}
+
+func (d testDirs) write(t *testing.T, path, content string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// failFile records 1.txt as failed in the index.
+func (d testDirs) failFile(t *testing.T) {
+	index, err := storage.NewPersistentStorage(filepath.Join(d.dst, storage.IndexDirName), logrus.NewEntry(logrus.New()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.PutFile(storage.FilesInfo{FileName: "1.txt", FilePath: filepath.Join(d.src, "1.txt"), Status: storage.Abandoned, LastError: "failed"})
+	if err = index.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name string
+		// setup prepares the directories and returns the arguments of the
+		// command to test.
+		setup func(t *testing.T, d testDirs) []string
+		want  int
+		// check checks the directories after the command.
+		check func(t *testing.T, d testDirs)
+	}{
+		{
+			name:  "unknown command",
+			setup: func(t *testing.T, d testDirs) []string { return []string{"frobnicate"} },
+			want:  exitUsage,
+		},
+		{
+			name:  "unknown flag",
+			setup: func(t *testing.T, d testDirs) []string { return d.args("sync", "-frobnicate") },
+			want:  exitUsage,
+		},
+		{
+			name:  "sync",
+			setup: func(t *testing.T, d testDirs) []string { return d.args("sync") },
+			want:  exitOK,
+		},
+		{
+			name: "sync into the source",
+			setup: func(t *testing.T, d testDirs) []string {
+				return []string{"sync", "-sourceDir", d.src, "-destDir", filepath.Join(d.src, "a"), "-logPath", filepath.Join(d.tmp, "log.txt")}
+			},
+			want: exitUsage,
+		},
+		{
+			name: "status synced",
+			setup: func(t *testing.T, d testDirs) []string {
+				d.mustRun(t, "sync")
+				return d.args("status")
+			},
+			want: exitOK,
+		},
+		{
+			name: "status with failed files",
+			setup: func(t *testing.T, d testDirs) []string {
+				d.failFile(t)
+				return d.args("status")
+			},
+			want: exitFailed,
+		},
+		{
+			name: "failed without failed files",
+			setup: func(t *testing.T, d testDirs) []string {
+				d.mustRun(t, "sync")
+				return d.args("failed")
+			},
+			want: exitOK,
+		},
+		{
+			name: "failed with failed files",
+			setup: func(t *testing.T, d testDirs) []string {
+				d.failFile(t)
+				return d.args("failed")
+			},
+			want: exitFailed,
+		},
+		{
+			name: "retry failed files",
+			setup: func(t *testing.T, d testDirs) []string {
+				d.failFile(t)
+				return d.args("retry")
+			},
+			want: exitOK,
+		},
+		{
+			name: "diff of synced directories",
+			setup: func(t *testing.T, d testDirs) []string {
+				d.mustRun(t, "sync")
+				return d.args("diff")
+			},
+			want: exitOK,
+		},
+		{
+			name:  "diff of different directories",
+			setup: func(t *testing.T, d testDirs) []string { return d.args("diff") },
+			want:  exitFailed,
+		},
+		{
+			name: "verify synced directories",
+			setup: func(t *testing.T, d testDirs) []string {
+				d.mustRun(t, "sync")
+				return d.args("verify")
+			},
+			want: exitOK,
+		},
+		{
+			name: "verify modified copy",
+			setup: func(t *testing.T, d testDirs) []string {
+				d.mustRun(t, "sync")
+				d.write(t, filepath.Join(d.dst, "1.txt"), "modified")
+				return d.args("verify")
+			},
+			want: exitFailed,
+		},
+		{
+			name: "verify and repair modified copy",
+			setup: func(t *testing.T, d testDirs) []string {
+				d.mustRun(t, "sync")
+				d.write(t, filepath.Join(d.dst, "1.txt"), "modified")
+				return d.args("verify", "-repair")
+			},
+			want: exitOK,
+			check: func(t *testing.T, d testDirs) {
+				if got, err := os.ReadFile(filepath.Join(d.dst, "1.txt")); err != nil || string(got) != "1" {
+					t.Errorf("1.txt = %q, %v, want %q", got, err, "1")
+				}
+			},
+		},
+		{
+			name:  "apply without a plan",
+			setup: func(t *testing.T, d testDirs) []string { return d.args("apply") },
+			want:  exitUsage,
+		},
+		{
+			name: "apply a plan",
+			setup: func(t *testing.T, d testDirs) []string {
+				planFile := filepath.Join(d.tmp, "plan.json")
+				d.mustRun(t, "sync", "-dry-run", "-planFile", planFile)
+				return d.args("apply", planFile)
+			},
+			want: exitOK,
+			check: func(t *testing.T, d testDirs) {
+				if got, err := os.ReadFile(filepath.Join(d.dst, "a", "2.txt")); err != nil || string(got) != "2" {
+					t.Errorf("a/2.txt = %q, %v, want %q", got, err, "2")
+				}
+			},
+		},
+		{
+			name: "apply a plan for other directories",
+			setup: func(t *testing.T, d testDirs) []string {
+				planFile := filepath.Join(d.tmp, "plan.json")
+				d.mustRun(t, "sync", "-dry-run", "-planFile", planFile)
+				return []string{"apply", "-sourceDir", d.src, "-destDir", filepath.Join(d.tmp, "other"), "-logPath", filepath.Join(d.tmp, "log.txt"), planFile}
+			},
+			want: exitFailed,
+		},
+		{
+			name:  "restore without a path",
+			setup: func(t *testing.T, d testDirs) []string { return d.args("restore") },
+			want:  exitUsage,
+		},
+		{
+			name: "restore with -version and -at",
+			setup: func(t *testing.T, d testDirs) []string {
+				return d.args("restore", "-version", "x", "-at", "y", "1.txt")
+			},
+			want: exitUsage,
+		},
+		{
+			name: "restore at a wrong time",
+			setup: func(t *testing.T, d testDirs) []string {
+				return d.args("restore", "-at", "yesterday", "-to", d.tmp, "1.txt")
+			},
+			want: exitUsage,
+		},
+		{
+			name:  "list versions of a missing file",
+			setup: func(t *testing.T, d testDirs) []string { return d.args("restore", "3.txt") },
+			want:  exitFailed,
+		},
+		{
+			name: "list versions",
+			setup: func(t *testing.T, d testDirs) []string {
+				d.mustRun(t, "sync")
+				return d.args("restore", "1.txt")
+			},
+			want: exitOK,
+		},
+		{
+			name: "restore a version without -to",
+			setup: func(t *testing.T, d testDirs) []string {
+				return d.args("restore", "-version", replacedVersion(t, d), "1.txt")
+			},
+			want: exitUsage,
+			check: func(t *testing.T, d testDirs) {
+				if got, err := os.ReadFile(filepath.Join(d.dst, "1.txt")); err != nil || string(got) != "new" {
+					t.Errorf("1.txt = %q, %v, want %q", got, err, "new")
+				}
+			},
+		},
+		{
+			name: "restore a version",
+			setup: func(t *testing.T, d testDirs) []string {
+				return d.args("restore", "-version", replacedVersion(t, d), "-to", filepath.Join(d.tmp, "restored"), "1.txt")
+			},
+			want: exitOK,
+			check: func(t *testing.T, d testDirs) {
+				if got, err := os.ReadFile(filepath.Join(d.tmp, "restored", "1.txt")); err != nil || string(got) != "1" {
+					t.Errorf("restored 1.txt = %q, %v, want %q", got, err, "1")
+				}
+			},
+		},
+		{
+			name: "restore a missing version",
+			setup: func(t *testing.T, d testDirs) []string {
+				return d.args("restore", "-at", time.Now().Format(time.RFC3339), "-to", d.tmp, "3.txt")
+			},
+			want: exitFailed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmp := t.TempDir()
+			d := testDirs{src: filepath.Join(tmp, "src"), dst: filepath.Join(tmp, "dst"), tmp: tmp}
+			d.write(t, filepath.Join(d.src, "1.txt"), "1")
+			d.write(t, filepath.Join(d.src, "a", "2.txt"), "2")
+			if err := os.MkdirAll(d.dst, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if got := run(tt.setup(t, d)); got != tt.want {
+				t.Errorf("exit code = %v, want %v", got, tt.want)
+			}
+			if tt.check != nil {
+				tt.check(t, d)
+			}
+		})
+	}
+}
+
+// replacedVersion syncs 1.txt, replaces it with new content and returns the
+// version of the first content.
+func replacedVersion(t *testing.T, d testDirs) string {
+	d.mustRun(t, "sync", "-versions")
+	d.write(t, filepath.Join(d.src, "1.txt"), "new")
+	d.mustRun(t, "sync", "-versions")
+	kept, err := versions.NewStore(d.dst, versions.Policy{}).List("1.txt")
+	if err != nil || len(kept) != 1 {
+		t.Fatalf("versions of 1.txt = %v, %v", kept, err)
+	}
+	return kept[0].Time.Format(time.RFC3339Nano)
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync_dir/internal/control"
+	"sync_dir/internal/ignore"
+	"sync_dir/internal/metrics"
+	"sync_dir/internal/scanner"
+	"sync_dir/internal/storage"
+	"sync_dir/internal/storage/generated_storage"
+	"sync_dir/internal/utils"
+	"sync_dir/internal/versions"
+	"time"
+)
+
+// config holds the settings shared by all commands.
+type config struct {
+	sourceDir, destDir, logLevel, logPath, indexDir string
+	hashAlgo, preserve, symlinks, exclude, include  string
+	planFormat, planFile, metricsAddr, controlAddr  string
+	restoreTo, restoreVersion, restoreAt, conflicts string
+	configPath, jobName, maxDeletes, sourceMarker   string
+	copyStrategy                                    string
+	scanInterval, verifyInterval                    int
+	copyWorkers, hashWorkers, retryAttempts         int
+	keepVersions, keepVersionsDays                  int
+	retryDelay, retryMaxDelay                       time.Duration
+	inotify, reconcile, removeExtra, reportSpecial  bool
+	dryRun, repair, versions, staggeredVersions     bool
+	twoWay, refuseEmptySource, acknowledgeDeletes   bool
+	excludeNestedDest, watch                        bool
+
+	// job is the name of the job in the config file, empty without one.
+	job            string
+	logFile        *os.File
+	logger         *logrus.Entry
+	hasher         utils.Hasher
+	copier         utils.CopyFunc
+	preserved      utils.Preserve
+	linkPolicy     scanner.LinkPolicy
+	conflictPolicy scanner.ConflictPolicy
+	deleteLimit    scanner.DeleteLimit
+	metrics        *metrics.Metrics
+	// versionStore is nil unless -versions is set.
+	versionStore *versions.Store
+	// nestedDest is the ignore pattern of destDir if it is inside sourceDir
+	// and -excludeNestedDest is set.
+	nestedDest string
+}
+
+// flagSet returns the flags of the command name, parsed into c.
+func (c *config) flagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&c.configPath, "config", "", "YAML, TOML or JSON file with the sync jobs to run, see README")
+	fs.StringVar(&c.jobName, "job", "", "Name of the job in the config file to run. By default all jobs")
+	fs.StringVar(&c.sourceDir, "sourceDir", ".", "Source directory to sync")
+	fs.StringVar(&c.destDir, "destDir", ".", "Destination directory to copy files")
+	fs.StringVar(&c.logLevel, "logLevel", "info", "Log level")
+	fs.StringVar(&c.logPath, "logPath", "log.txt", "Path to log file")
+	fs.StringVar(&c.indexDir, "indexDir", "", "Directory to keep the file index in. By default .sync_dir inside destDir")
+	fs.StringVar(&c.hashAlgo, "hash", utils.DefaultHashAlgo, "Hash algorithm to detect changes: "+strings.Join(utils.HashAlgos(), ", "))
+	fs.StringVar(&c.copyStrategy, "copy", utils.DefaultCopyStrategy, "How changed files are copied: full rewrites them, delta writes only the changed blocks of large files on file systems with reflinks (Btrfs, XFS), elsewhere it copies like full")
+	fs.StringVar(&c.preserve, "preserve", "mode,times", "Comma separated file metadata to preserve: mode, times, owner, xattr")
+	fs.StringVar(&c.symlinks, "symlinks", string(scanner.LinkCopy), "What to do with symlinks: copy, follow or skip")
+	fs.BoolVar(&c.reportSpecial, "reportSpecial", false, "Log skipped sockets, FIFOs and devices as warnings")
+	fs.StringVar(&c.exclude, "exclude", "", "Comma separated gitignore style patterns of files to exclude")
+	fs.StringVar(&c.include, "include", "", "Comma separated gitignore style patterns of excluded files to include back")
+	fs.IntVar(&c.scanInterval, "scanInterval", 15, "Time interval for scanning in seconds")
+	fs.BoolVar(&c.reconcile, "reconcile", true, "Compare existing destination files with the source before the first scan")
+	fs.BoolVar(&c.removeExtra, "removeExtra", false, "Remove files found only in the destination directory during reconcile")
+	fs.BoolVar(&c.dryRun, "dry-run", false, "Print copies, updates and deletions of one sync pass without changing anything")
+	fs.StringVar(&c.planFormat, "planFormat", "table", "Format of the dry run plan: table or json")
+	fs.StringVar(&c.planFile, "planFile", "", "Save the dry run plan as JSON to this file to apply it later with the apply command")
+	fs.IntVar(&c.verifyInterval, "verifyInterval", 0, "Time interval for verifying destination files against the index in minutes, 0 disables it")
+	fs.BoolVar(&c.repair, "repair", false, "Restore modified and missing destination files from the source and remove unexpected ones when verifying")
+	fs.IntVar(&c.copyWorkers, "copyWorkers", runtime.NumCPU(), "Number of files copied at once")
+	fs.IntVar(&c.hashWorkers, "hashWorkers", runtime.NumCPU(), "Number of files hashed at once")
+	fs.IntVar(&c.retryAttempts, "retryAttempts", 5, "Number of attempts to sync a failing file before giving it up")
+	fs.DurationVar(&c.retryDelay, "retryDelay", time.Second, "Delay before the first retry of a failed file, doubled for every next attempt")
+	fs.DurationVar(&c.retryMaxDelay, "retryMaxDelay", 5*time.Minute, "Maximum delay between retries of a failed file")
+	fs.BoolVar(&c.versions, "versions", false, "Keep previous copies of overwritten and deleted destination files in "+versions.DirName)
+	fs.IntVar(&c.keepVersions, "keepVersions", 0, "Number of the newest versions of a file to keep, 0 keeps all")
+	fs.IntVar(&c.keepVersionsDays, "keepVersionsDays", 0, "Number of days to keep versions for, 0 keeps them forever")
+	fs.BoolVar(&c.staggeredVersions, "staggeredVersions", false, "Keep one version per hour for a day, per day for a month and per week after that")
+	fs.StringVar(&c.restoreVersion, "version", "", "For restore: time of the version to restore, as listed by restore")
+	fs.StringVar(&c.restoreAt, "at", "", "For restore: restore files as they were at this time, RFC3339")
+	fs.StringVar(&c.restoreTo, "to", "", "For restore: directory to restore files to. Required, destDir replaces the synced files without updating the index")
+	fs.BoolVar(&c.twoWay, "twoWay", false, "Sync changes made in destDir back to sourceDir as well")
+	fs.StringVar(&c.conflicts, "conflicts", string(scanner.ConflictNewest), "What to do with files changed in both directories in two-way mode: newest, source or keep-both")
+	fs.BoolVar(&c.excludeNestedDest, "excludeNestedDest", false, "Leave destDir out of scans if it is inside sourceDir instead of refusing to run")
+	fs.StringVar(&c.maxDeletes, "maxDeletes", "", "Maximum files deleted in one pass because they are missing in sourceDir, a number or a percentage like 10%. Empty means no limit")
+	fs.BoolVar(&c.refuseEmptySource, "refuseEmptySource", true, "Hold deletions while sourceDir is empty")
+	fs.StringVar(&c.sourceMarker, "sourceMarker", "", "File that must exist in sourceDir for files to be deleted, for example .sync_dir_marker")
+	fs.BoolVar(&c.acknowledgeDeletes, "acknowledgeDeletes", false, "Let the deletions of the first pass past -maxDeletes and -refuseEmptySource")
+	fs.StringVar(&c.metricsAddr, "metricsAddr", "", "Address to serve Prometheus metrics on at /metrics, for example :9090. Empty disables metrics")
+	fs.StringVar(&c.controlAddr, "controlAddr", "", "Address of the control API for the watch command: loopback host:port or unix:/path/to/socket. Empty disables the API")
+	fs.BoolVar(&c.inotify, "inotify", false, "Watch source directory for changes with inotify, periodic scans are kept as a fallback")
+	fs.BoolVar(&c.watch, "watch", false, "Deprecated: use -inotify")
+	return fs
+}
+
+// validate checks the parsed flags and fills the settings derived from them.
+func (c *config) validate() error {
+	if c.indexDir == "" {
+		c.indexDir = filepath.Join(c.destDir, storage.IndexDirName)
+	}
+	if c.watch {
+		fmt.Fprintln(os.Stderr, "-watch is deprecated, use -inotify")
+		c.inotify = true
+	}
+	var err error
+	if c.hasher, err = utils.NewHasher(c.hashAlgo); err != nil {
+		return err
+	}
+	if c.copier, err = utils.NewCopier(c.copyStrategy); err != nil {
+		return err
+	}
+	if c.preserved, err = utils.ParsePreserve(c.preserve); err != nil {
+		return err
+	}
+	if c.linkPolicy, err = scanner.ParseLinkPolicy(c.symlinks); err != nil {
+		return err
+	}
+	if c.conflictPolicy, err = scanner.ParseConflictPolicy(c.conflicts); err != nil {
+		return err
+	}
+	if c.deleteLimit, err = scanner.ParseDeleteLimit(c.maxDeletes); err != nil {
+		return err
+	}
+	if c.twoWay && c.dryRun {
+		return fmt.Errorf("dry run is not supported in two-way mode")
+	}
+	if c.versions {
+		c.versionStore = versions.NewStore(c.destDir, versions.Policy{
+			KeepLast:  c.keepVersions,
+			KeepFor:   time.Duration(c.keepVersionsDays) * 24 * time.Hour,
+			Staggered: c.staggeredVersions,
+		})
+	}
+	if c.planFormat != "table" && c.planFormat != "json" {
+		return fmt.Errorf("unknown plan format %q, supported: table, json", c.planFormat)
+	}
+	return nil
+}
+
+// openLog opens the log file shared by all jobs.
+func (c *config) openLog() error {
+	var err error
+	if c.logFile, err = os.OpenFile(c.logPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666); err != nil {
+		return fmt.Errorf("error opening file: %v", err)
+	}
+	level, _ := logrus.ParseLevel(c.logLevel)
+	c.logger = utils.DefaultLogger(c.logFile, level)
+	return nil
+}
+
+func (c *config) Close() error {
+	return c.logFile.Close()
+}
+
+// checkDirs refuses overlapping source and destination directories. With
+// -excludeNestedDest a destination inside the source is left out of scans.
+func (c *config) checkDirs() error {
+	nested, err := scanner.NestedDest(c.sourceDir, c.destDir)
+	if err != nil || nested == "" {
+		return err
+	}
+	if !c.excludeNestedDest {
+		return fmt.Errorf("destination directory %v is inside source directory %v, set -excludeNestedDest to leave it out of scans", c.destDir, c.sourceDir)
+	}
+	c.nestedDest = "/" + ignore.Escape(filepath.ToSlash(nested)) + "/"
+	c.logger.Warnf("Destination directory %v is inside source directory %v, it is left out of scans", c.destDir, c.sourceDir)
+	return nil
+}
+
+// openStorage loads the index. A read only index is kept in memory and
+// changes made to it are not saved.
+func (c *config) openStorage(readOnly bool) (*storage.Files, error) {
+	var fileStorage *storage.Files
+	var err error
+	if readOnly {
+		fileStorage, err = storage.LoadFileStorage(c.indexDir, c.logger)
+	} else {
+		fileStorage, err = storage.NewPersistentStorage(c.indexDir, c.logger)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error loading index: %v", err)
+	}
+	fileStorage.WithHasher(c.hasher)
+	if !readOnly {
+		c.removeTempFiles()
+		if c.versionStore != nil {
+			fileStorage.WithVersions(c.versionStore)
+		}
+		fileStorage.MigrateHashes(c.sourceDir, c.destDir)
+	}
+	return fileStorage, nil
+}
+
+func (c *config) closeStorage(fileStorage *storage.Files) {
+	if err := fileStorage.Close(); err != nil {
+		c.logger.Errorf("error saving index: %v", err)
+	}
+}
+
+// serveControl starts the control API if -controlAddr is set, until ctx is
+// done. shutdown is called when the API is asked to shut down.
+func (c *config) serveControl(ctx context.Context, fileScanner scanner.FileScanner, index control.Index, shutdown func()) error {
+	if c.controlAddr == "" {
+		return nil
+	}
+	listener, err := control.Listen(c.controlAddr)
+	if err != nil {
+		return fmt.Errorf("error serving control API: %v", err)
+	}
+	server := control.NewServer(fileScanner, index, shutdown, c.logger)
+	go func() {
+		if err := server.Serve(ctx, listener); err != nil {
+			c.logger.Errorf("error serving control API: %v", err)
+		}
+	}()
+	c.logger.Infof("Serving control API on %v", listener.Addr())
+	return nil
+}
+
+func (c *config) newScanner(ctx context.Context, fileStorage *storage.Files) *scanner.DirScanner {
+	fileToSync := make(chan string, 5)
+	syncDone := make(chan string, 5)
+	var instrumented storage.Storage = fileStorage
+	if c.metrics != nil {
+		instrumented = metrics.NewStorageWithMetrics(fileStorage, c.metrics)
+	}
+	wrappedStorage := generated_storage.NewStorageWithLogrus(instrumented, c.logger)
+	dirScanner := scanner.NewDirScanner(c.sourceDir, c.destDir, ctx, fileToSync, syncDone, c.logger, wrappedStorage, &sync.WaitGroup{}, c.scanInterval).
+		WithOptions(scanner.Options{
+			Watch:              c.inotify,
+			Reconcile:          c.reconcile,
+			RemoveExtra:        c.removeExtra,
+			Hasher:             c.hasher,
+			Preserve:           c.preserved,
+			Symlinks:           c.linkPolicy,
+			ReportSpecial:      c.reportSpecial,
+			Ignore:             c.ignorePatterns(),
+			VerifyInterval:     time.Duration(c.verifyInterval) * time.Minute,
+			Repair:             c.repair,
+			CopyWorkers:        c.copyWorkers,
+			HashWorkers:        c.hashWorkers,
+			RetryAttempts:      c.retryAttempts,
+			RetryDelay:         c.retryDelay,
+			RetryMaxDelay:      c.retryMaxDelay,
+			Versions:           c.versionStore,
+			TwoWay:             c.twoWay,
+			Conflicts:          c.conflictPolicy,
+			MaxDeletes:         c.deleteLimit,
+			RefuseEmpty:        c.refuseEmptySource,
+			Marker:             c.sourceMarker,
+			Copy:               c.copier,
+			AcknowledgeDeletes: c.acknowledgeDeletes,
+		})
+	if c.metrics != nil {
+		dirScanner.WithWrapper(metrics.NewFileScannerWithMetrics(dirScanner, c.metrics))
+		c.metrics.BytesCopied(dirScanner.Written)
+		c.metrics.Scanned(dirScanner.Scanned)
+		c.metrics.Queue("filesToSync", fileToSync)
+		c.metrics.Queue("syncDone", syncDone)
+		c.metrics.IndexSize(fileStorage.Len)
+		c.metrics.FilesDeleted(fileStorage.Deleted)
+		c.metrics.DeletesHeld(dirScanner.DeletesHeld)
+	}
+	return dirScanner
+}
+
+func (c *config) removeTempFiles() {
+	removed, err := utils.RemoveTempFiles(c.destDir)
+	if err != nil {
+		c.logger.Errorf("error removing temporary files: %v", err)
+	} else if removed > 0 {
+		c.logger.Infof("Removed %v temporary files left by interrupted copies", removed)
+	}
+}
+
+func (c *config) ignorePatterns() []string {
+	var patterns []string
+	for _, pattern := range strings.Split(c.exclude, ",") {
+		if pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	for _, pattern := range strings.Split(c.include, ",") {
+		if pattern != "" {
+			patterns = append(patterns, "!"+pattern)
+		}
+	}
+	if c.nestedDest != "" {
+		// Added last, so include patterns can't bring the destination back.
+		patterns = append(patterns, c.nestedDest)
+	}
+	return patterns
+}
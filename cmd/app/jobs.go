@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync_dir/internal/metrics"
+	"sync_dir/internal/scanner"
+)
+
+// sharedSettings belong to the whole process, a config file sets them at
+// the top level and not in a job.
+var sharedSettings = []string{"config", "job", "logPath", "logLevel", "metricsAddr"}
+
+// jobSettings are set by every job of a config file itself.
+var jobSettings = []string{"sourceDir", "destDir", "indexDir"}
+
+// jobs are the configs of the sync jobs run by one process. They share the
+// log file and the metrics.
+type jobs []*config
+
+// jobsFile is a config file: settings at the top level apply to every job,
+// the settings of a job override them. Settings are named like the flags.
+type jobsFile struct {
+	settings map[string]interface{}
+	jobs     []job
+}
+
+type job struct {
+	name     string
+	settings map[string]interface{}
+}
+
+// loadJobs parses the flags of a command. With -config it returns a config
+// for every job of the file, or for the one chosen with -job, otherwise a
+// single config of the flags. Flags override the settings of the file.
+func loadJobs(name string, args []string) (jobs, []string, error) {
+	c := &config{}
+	fs := c.flagSet(name)
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	if c.configPath == "" {
+		if c.jobName != "" {
+			return nil, nil, fmt.Errorf("-job needs -config")
+		}
+		if err := c.validate(); err != nil {
+			return nil, nil, err
+		}
+		if err := c.openLog(); err != nil {
+			return nil, nil, err
+		}
+		return jobs{c}, fs.Args(), nil
+	}
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		for _, setting := range jobSettings {
+			if f.Name == setting && err == nil {
+				err = fmt.Errorf("-%v can not be used with -config, set it in the jobs of %v", setting, c.configPath)
+			}
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := readJobsFile(c.configPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	shared := &config{}
+	sharedFlags := shared.flagSet(name)
+	if err = applySettings(sharedFlags, file.settings); err != nil {
+		return nil, nil, fmt.Errorf("%v: %v", c.configPath, err)
+	}
+	if err = sharedFlags.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	var all jobs
+	for _, j := range file.jobs {
+		jc := &config{job: j.name}
+		jobFlags := jc.flagSet(name)
+		if err = applySettings(jobFlags, file.settings); err != nil {
+			return nil, nil, fmt.Errorf("%v: %v", c.configPath, err)
+		}
+		if err = applySettings(jobFlags, j.settings); err != nil {
+			return nil, nil, fmt.Errorf("%v: job %v: %v", c.configPath, j.name, err)
+		}
+		if err = jobFlags.Parse(args); err != nil {
+			return nil, nil, err
+		}
+		if err = jc.validate(); err != nil {
+			return nil, nil, fmt.Errorf("job %v: %v", j.name, err)
+		}
+		all = append(all, jc)
+	}
+	if err = all.check(); err != nil {
+		return nil, nil, fmt.Errorf("%v: %v", c.configPath, err)
+	}
+	if c.jobName != "" {
+		if all = all.find(c.jobName); all == nil {
+			return nil, nil, fmt.Errorf("no job %q in %v", c.jobName, c.configPath)
+		}
+	}
+	if err = shared.openLog(); err != nil {
+		return nil, nil, err
+	}
+	for _, jc := range all {
+		jc.logFile = shared.logFile
+		jc.logger = shared.logger.WithField("job", jc.job)
+	}
+	return all, fs.Args(), nil
+}
+
+// readJobsFile reads a config file, its format is chosen by the extension.
+func readJobsFile(path string) (*jobsFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config: %v", err)
+	}
+	raw := map[string]interface{}{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	case ".toml":
+		err = toml.Unmarshal(data, &raw)
+	case ".json":
+		err = json.Unmarshal(data, &raw)
+	default:
+		return nil, fmt.Errorf("unknown config format %q, supported: .yaml, .yml, .toml, .json", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading config %v: %v", path, err)
+	}
+	file, err := parseJobsFile(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return file, nil
+}
+
+func parseJobsFile(raw map[string]interface{}) (*jobsFile, error) {
+	var list []map[string]interface{}
+	switch value := raw["jobs"].(type) {
+	case []map[string]interface{}:
+		list = value
+	case []interface{}:
+		for _, item := range value {
+			settings, ok := item.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("jobs must be a list of tables")
+			}
+			list = append(list, settings)
+		}
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("no jobs")
+	}
+	file := &jobsFile{settings: map[string]interface{}{}}
+	for key, value := range raw {
+		if key != "jobs" {
+			file.settings[key] = value
+		}
+	}
+	for i, item := range list {
+		name, _ := item["name"].(string)
+		if name == "" {
+			return nil, fmt.Errorf("job %v has no name", i+1)
+		}
+		j := job{name: name, settings: map[string]interface{}{}}
+		for key, value := range item {
+			if key != "name" {
+				j.settings[key] = value
+			}
+		}
+		for _, setting := range sharedSettings {
+			if _, ok := j.settings[setting]; ok {
+				return nil, fmt.Errorf("job %v: %v can only be set at the top level", name, setting)
+			}
+		}
+		file.jobs = append(file.jobs, j)
+	}
+	return file, nil
+}
+
+// applySettings sets the flags named by the settings.
+func applySettings(fs *flag.FlagSet, settings map[string]interface{}) error {
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if fs.Lookup(key) == nil {
+			return fmt.Errorf("unknown setting %q", key)
+		}
+		if err := fs.Set(key, settingValue(settings[key])); err != nil {
+			return fmt.Errorf("invalid value of %v: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// settingValue formats a setting as a flag value. Lists are joined with
+// commas, like -exclude takes them.
+func settingValue(value interface{}) string {
+	switch value := value.(type) {
+	case []interface{}:
+		items := make([]string, len(value))
+		for i, item := range value {
+			items[i] = settingValue(item)
+		}
+		return strings.Join(items, ",")
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+// check rejects jobs that would get in the way of each other.
+func (j jobs) check() error {
+	names := map[string]bool{}
+	indexes := map[string]string{}
+	controlAddrs := map[string]string{}
+	for _, c := range j {
+		if names[c.job] {
+			return fmt.Errorf("job %v is declared twice", c.job)
+		}
+		names[c.job] = true
+		indexDir, err := filepath.Abs(c.indexDir)
+		if err != nil {
+			return err
+		}
+		if other, ok := indexes[indexDir]; ok {
+			return fmt.Errorf("jobs %v and %v share the index %v, set indexDir of one of them", other, c.job, c.indexDir)
+		}
+		indexes[indexDir] = c.job
+		if other, ok := controlAddrs[c.controlAddr]; ok && c.controlAddr != "" {
+			return fmt.Errorf("jobs %v and %v share the control API address %v", other, c.job, c.controlAddr)
+		}
+		controlAddrs[c.controlAddr] = c.job
+	}
+	for i, c := range j {
+		for _, other := range j[i+1:] {
+			if err := c.checkOtherJob(other); err != nil {
+				return err
+			}
+			if err := other.checkOtherJob(c); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkOtherJob rejects jobs c and other if c writes to the directories other
+// writes to or reads from.
+func (c *config) checkOtherJob(other *config) error {
+	overlap, err := scanner.Overlap(c.destDir, other.destDir)
+	if err != nil {
+		return err
+	}
+	if overlap {
+		return fmt.Errorf("destination directories %v of job %v and %v of job %v overlap", c.destDir, c.job, other.destDir, other.job)
+	}
+	if overlap, err = scanner.Overlap(c.destDir, other.sourceDir); err != nil {
+		return err
+	}
+	if overlap {
+		return fmt.Errorf("destination directory %v of job %v overlaps source directory %v of job %v", c.destDir, c.job, other.sourceDir, other.job)
+	}
+	return nil
+}
+
+// find returns the job name alone, or nil if there is no such job.
+func (j jobs) find(name string) jobs {
+	for _, c := range j {
+		if c.job == name {
+			return jobs{c}
+		}
+	}
+	return nil
+}
+
+func (j jobs) Close() error {
+	return j[0].Close()
+}
+
+// run runs cmd for the jobs and returns the worst exit code. Commands that
+// run one job at a time need -job if there are several.
+func (j jobs) run(ctx context.Context, cmd *command, args []string) int {
+	if cmd.jobs == oneJob && len(j) > 1 {
+		err := fmt.Errorf("%v runs one job at a time, choose it with -job", cmd.name)
+		j[0].logger.Error(err)
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	if cmd.jobs != oneJob {
+		if err := j.serveMetrics(ctx); err != nil {
+			j[0].logger.Error(err)
+			fmt.Fprintln(os.Stderr, err)
+			return exitFailed
+		}
+	}
+	codes := make([]int, len(j))
+	if cmd.jobs == allJobs {
+		wg := sync.WaitGroup{}
+		for i, c := range j {
+			wg.Add(1)
+			go func(i int, c *config) {
+				defer wg.Done()
+				codes[i] = runJob(ctx, cmd, c, args)
+			}(i, c)
+		}
+		wg.Wait()
+	} else {
+		for i, c := range j {
+			codes[i] = runJob(ctx, cmd, c, args)
+		}
+	}
+	code := exitOK
+	for _, jobCode := range codes {
+		if jobCode > code {
+			code = jobCode
+		}
+	}
+	return code
+}
+
+func runJob(ctx context.Context, cmd *command, c *config, args []string) int {
+	if cmd.scans {
+		if err := c.checkDirs(); err != nil {
+			c.report(err)
+			return exitUsage
+		}
+	}
+	code, err := cmd.run(ctx, c, args)
+	if err != nil {
+		c.report(err)
+	}
+	return code
+}
+
+// report logs an error of the job and prints it.
+func (c *config) report(err error) {
+	c.logger.Error(err)
+	if c.job != "" {
+		err = fmt.Errorf("%v: %v", c.job, err)
+	}
+	fmt.Fprintln(os.Stderr, err)
+}
+
+// serveMetrics starts serving metrics if -metricsAddr is set, until ctx is
+// done. Scanners created afterwards are instrumented. The metrics of the
+// jobs of a config file are labelled with the job name.
+func (j jobs) serveMetrics(ctx context.Context) error {
+	c := j[0]
+	if c.metricsAddr == "" {
+		return nil
+	}
+	listener, err := net.Listen("tcp", c.metricsAddr)
+	if err != nil {
+		return fmt.Errorf("error serving metrics: %v", err)
+	}
+	var handler http.Handler
+	if c.job == "" {
+		c.metrics = metrics.New()
+		handler = c.metrics.Handler()
+	} else {
+		all := metrics.NewJobs()
+		for _, jc := range j {
+			jc.metrics = all.Job(jc.job)
+		}
+		handler = all.Handler()
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", handler)
+	server := &http.Server{Handler: mux}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			c.logger.Errorf("error serving metrics: %v", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	c.logger.Infof("Serving metrics on http://%v/metrics", listener.Addr())
+	return nil
+}
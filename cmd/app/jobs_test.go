@@ -0,0 +1,336 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseJobsFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      map[string]interface{}
+		wantJobs []string
+		wantErr  string
+	}{
+		{
+			name: "jobs",
+			raw: map[string]interface{}{
+				"logLevel": "debug",
+				"jobs": []interface{}{
+					map[string]interface{}{"name": "docs", "sourceDir": "/src/docs"},
+					map[string]interface{}{"name": "photos", "sourceDir": "/src/photos"},
+				},
+			},
+			wantJobs: []string{"docs", "photos"},
+		},
+		{
+			name:     "typed list",
+			raw:      map[string]interface{}{"jobs": []map[string]interface{}{{"name": "docs"}}},
+			wantJobs: []string{"docs"},
+		},
+		{name: "no jobs", raw: map[string]interface{}{"logLevel": "debug"}, wantErr: "no jobs"},
+		{name: "jobs not tables", raw: map[string]interface{}{"jobs": []interface{}{"docs"}}, wantErr: "list of tables"},
+		{name: "job without name", raw: map[string]interface{}{"jobs": []interface{}{map[string]interface{}{"sourceDir": "/src"}}}, wantErr: "job 1 has no name"},
+		{
+			name:    "shared setting in a job",
+			raw:     map[string]interface{}{"jobs": []interface{}{map[string]interface{}{"name": "docs", "logPath": "docs.log"}}},
+			wantErr: "logPath can only be set at the top level",
+		},
+		{
+			name:    "metrics address in a job",
+			raw:     map[string]interface{}{"jobs": []interface{}{map[string]interface{}{"name": "docs", "metricsAddr": ":9090"}}},
+			wantErr: "metricsAddr can only be set at the top level",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file, err := parseJobsFile(tt.raw)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseJobsFile() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseJobsFile() error = %v", err)
+			}
+			var names []string
+			for _, j := range file.jobs {
+				names = append(names, j.name)
+				if _, ok := j.settings["name"]; ok {
+					t.Errorf("job %v settings contain its name", j.name)
+				}
+			}
+			if !reflect.DeepEqual(names, tt.wantJobs) {
+				t.Errorf("parseJobsFile() jobs = %v, want %v", names, tt.wantJobs)
+			}
+			if _, ok := file.settings["jobs"]; ok {
+				t.Errorf("parseJobsFile() settings contain the jobs")
+			}
+		})
+	}
+}
+
+func TestApplySettings(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings map[string]interface{}
+		want     func(c *config) bool
+		wantErr  bool
+	}{
+		{name: "string", settings: map[string]interface{}{"hash": "sha256"}, want: func(c *config) bool { return c.hashAlgo == "sha256" }},
+		{name: "JSON number", settings: map[string]interface{}{"scanInterval": float64(30)}, want: func(c *config) bool { return c.scanInterval == 30 }},
+		{name: "TOML number", settings: map[string]interface{}{"copyWorkers": int64(3)}, want: func(c *config) bool { return c.copyWorkers == 3 }},
+		{name: "bool", settings: map[string]interface{}{"reconcile": false}, want: func(c *config) bool { return !c.reconcile }},
+		{name: "list", settings: map[string]interface{}{"exclude": []interface{}{"*.tmp", "cache/"}}, want: func(c *config) bool { return c.exclude == "*.tmp,cache/" }},
+		{name: "duration", settings: map[string]interface{}{"retryDelay": "2s"}, want: func(c *config) bool { return c.retryDelay.String() == "2s" }},
+		{name: "unknown setting", settings: map[string]interface{}{"sourceDirs": "/src"}, wantErr: true},
+		{name: "invalid value", settings: map[string]interface{}{"scanInterval": "often"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &config{}
+			err := applySettings(c.flagSet("sync"), tt.settings)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("applySettings() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !tt.want(c) {
+				t.Errorf("applySettings() config = %+v", c)
+			}
+		})
+	}
+}
+
+func TestReadJobsFile(t *testing.T) {
+	files := map[string]string{
+		"jobs.yaml": `
+scanInterval: 10
+exclude: ["*.tmp", "cache/"]
+jobs:
+  - name: docs
+    sourceDir: /src/docs
+    reconcile: false
+`,
+		"jobs.toml": `
+scanInterval = 10
+exclude = ["*.tmp", "cache/"]
+
+[[jobs]]
+name = "docs"
+sourceDir = "/src/docs"
+reconcile = false
+`,
+		"jobs.json": `{
+  "scanInterval": 10,
+  "exclude": ["*.tmp", "cache/"],
+  "jobs": [{"name": "docs", "sourceDir": "/src/docs", "reconcile": false}]
+}`,
+	}
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), name)
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			file, err := readJobsFile(path)
+			if err != nil {
+				t.Fatalf("readJobsFile() error = %v", err)
+			}
+			if len(file.jobs) != 1 || file.jobs[0].name != "docs" {
+				t.Fatalf("readJobsFile() jobs = %+v", file.jobs)
+			}
+			c := &config{}
+			fs := c.flagSet("sync")
+			if err = applySettings(fs, file.settings); err != nil {
+				t.Fatalf("applySettings() error = %v", err)
+			}
+			if err = applySettings(fs, file.jobs[0].settings); err != nil {
+				t.Fatalf("applySettings() error = %v", err)
+			}
+			if c.scanInterval != 10 || c.exclude != "*.tmp,cache/" || c.sourceDir != "/src/docs" || c.reconcile {
+				t.Errorf("config = %+v", c)
+			}
+		})
+	}
+	t.Run("unknown format", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "jobs.ini")
+		if err := os.WriteFile(path, []byte("scanInterval=10"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readJobsFile(path); err == nil {
+			t.Errorf("readJobsFile() error = nil for an unknown format")
+		}
+	})
+}
+
+func TestLoadJobs(t *testing.T) {
+	tests := []struct {
+		name string
+		// jobs is the jobs part of a YAML config, dirs are relative to a
+		// temporary directory.
+		jobs string
+		args []string
+		// want is the scanInterval of each job loaded.
+		want    map[string]int
+		wantErr string
+	}{
+		{
+			name: "job settings override the top level",
+			jobs: `
+  - name: docs
+    sourceDir: src/docs
+    destDir: dst/docs
+    scanInterval: 20
+  - name: photos
+    sourceDir: src/photos
+    destDir: dst/photos
+`,
+			want: map[string]int{"docs": 20, "photos": 10},
+		},
+		{
+			name: "flags override jobs",
+			jobs: `
+  - name: docs
+    sourceDir: src/docs
+    destDir: dst/docs
+    scanInterval: 20
+  - name: photos
+    sourceDir: src/photos
+    destDir: dst/photos
+`,
+			args: []string{"-scanInterval", "30"},
+			want: map[string]int{"docs": 30, "photos": 30},
+		},
+		{
+			name: "choose a job",
+			jobs: `
+  - name: docs
+    sourceDir: src/docs
+    destDir: dst/docs
+  - name: photos
+    sourceDir: src/photos
+    destDir: dst/photos
+`,
+			args: []string{"-job", "photos"},
+			want: map[string]int{"photos": 10},
+		},
+		{
+			name: "unknown job",
+			jobs: `
+  - name: docs
+    sourceDir: src/docs
+    destDir: dst/docs
+`,
+			args:    []string{"-job", "photos"},
+			wantErr: `no job "photos"`,
+		},
+		{
+			name: "job dirs as flags",
+			jobs: `
+  - name: docs
+    sourceDir: src/docs
+    destDir: dst/docs
+`,
+			args:    []string{"-destDir", "dst"},
+			wantErr: "-destDir can not be used with -config",
+		},
+		{
+			name: "duplicate names",
+			jobs: `
+  - name: docs
+    sourceDir: src/docs
+    destDir: dst/docs
+  - name: docs
+    sourceDir: src/photos
+    destDir: dst/photos
+`,
+			wantErr: "job docs is declared twice",
+		},
+		{
+			name: "shared index",
+			jobs: `
+  - name: docs
+    sourceDir: src/docs
+    destDir: dst/docs
+    indexDir: index
+  - name: photos
+    sourceDir: src/photos
+    destDir: dst/photos
+    indexDir: index
+`,
+			wantErr: "share the index",
+		},
+		{
+			name: "shared control address",
+			jobs: `
+  - name: docs
+    sourceDir: src/docs
+    destDir: dst/docs
+    controlAddr: 127.0.0.1:7070
+  - name: photos
+    sourceDir: src/photos
+    destDir: dst/photos
+    controlAddr: 127.0.0.1:7070
+`,
+			wantErr: "share the control API address",
+		},
+		{
+			name: "nested destinations",
+			jobs: `
+  - name: docs
+    sourceDir: src/docs
+    destDir: dst
+  - name: photos
+    sourceDir: src/photos
+    destDir: dst/photos
+`,
+			wantErr: "destination directories",
+		},
+		{
+			name: "destination inside another source",
+			jobs: `
+  - name: docs
+    sourceDir: src
+    destDir: dst/docs
+  - name: photos
+    sourceDir: dst/docs/photos
+    destDir: src/photos
+`,
+			wantErr: "overlaps source directory",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			jobsFile := strings.ReplaceAll(tt.jobs, ": src", ": "+filepath.Join(dir, "src"))
+			jobsFile = strings.ReplaceAll(jobsFile, ": dst", ": "+filepath.Join(dir, "dst"))
+			jobsFile = strings.ReplaceAll(jobsFile, ": index", ": "+filepath.Join(dir, "index"))
+			content := "scanInterval: 10\nlogPath: " + filepath.Join(dir, "log.txt") + "\njobs:" + jobsFile
+			path := filepath.Join(dir, "jobs.yaml")
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			all, _, err := loadJobs("sync", append([]string{"-config", path}, tt.args...))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadJobs() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadJobs() error = %v", err)
+			}
+			defer all.Close()
+			got := map[string]int{}
+			for _, c := range all {
+				got[c.job] = c.scanInterval
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("loadJobs() scanInterval by job = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
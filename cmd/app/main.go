@@ -2,44 +2,45 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
-	"github.com/sirupsen/logrus"
-	"log"
+	"fmt"
 	"os"
 	"os/signal"
-	"sync"
-	"sync_dir/internal/scanner"
-	"sync_dir/internal/scanner/generated_scanner"
-	"sync_dir/internal/storage"
-	"sync_dir/internal/storage/generated_storage"
-	"sync_dir/internal/utils"
+	"strings"
 	"syscall"
 )
 
-var (
-	sourceDir, destDir, logLevel, logPath *string
-	timeInterval                          *int
-	logger                                *logrus.Entry
-)
-
-func init() {
-	sourceDir = flag.String("sourceDir", ".", "Source directory to sync")
-	destDir = flag.String("destDir", ".", "Destination directory to copy files")
-	logLevel = flag.String("logLevel", "info", "Log level")
-	logPath = flag.String("logPath", "log.txt", "Path to log file")
-	timeInterval = flag.Int("scanInterval", 15, "Time interval for scanning in seconds")
+func main() {
+	os.Exit(run(os.Args[1:]))
 }
 
-func main() {
-	flag.Parse()
-	file, err := os.OpenFile(*logPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+// run executes the command named by the first argument. Without a command
+// the flags are passed to watch, as before subcommands were added.
+func run(args []string) int {
+	name := "watch"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	var cmd *command
+	for i := range commands {
+		if commands[i].name == name {
+			cmd = &commands[i]
+		}
+	}
+	if cmd == nil {
+		printUsage()
+		return exitUsage
+	}
+	jobs, args, err := loadJobs(name, args)
+	if errors.Is(err, flag.ErrHelp) {
+		return exitOK
+	}
 	if err != nil {
-		log.Fatalf("error opening file: %v", err)
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
 	}
-	defer file.Close()
-
-	level, _ := logrus.ParseLevel(*logLevel)
-	logger = utils.DefaultLogger(file, level)
+	defer jobs.Close()
 
 	ctx := context.Background()
 	ctx, cancel := signal.NotifyContext(ctx,
@@ -48,13 +49,13 @@ func main() {
 		syscall.SIGTERM,
 		syscall.SIGQUIT)
 	defer cancel()
-	fileToSync := make(chan string, 5)
-	syncDone := make(chan string, 5)
-	fileStorage := storage.NewFileStorage(map[string]storage.FilesInfo{}, logger)
-	wrappedStorage := generated_storage.NewStorageWithLogrus(fileStorage, logger)
-	dirScanner := generated_scanner.NewFileScannerWithLogrus(
-		scanner.NewDirScanner(*sourceDir, *destDir, ctx, fileToSync, syncDone, logger, wrappedStorage, &sync.WaitGroup{}, *timeInterval),
-		logger)
-	dirScanner.Run()
-	dirScanner.Wait()
+	return jobs.run(ctx, cmd, args)
+}
+
+func printUsage() {
+	fmt.Fprintf(os.Stderr, "Usage: %v <command> [flags]\n\nCommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8v %v\n", cmd.name, cmd.usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun %v <command> -h to list flags.\n", os.Args[0])
 }
@@ -0,0 +1,207 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync_dir/internal/scanner"
+	"sync_dir/internal/storage"
+)
+
+// Index is the part of the storage the API reads files from.
+type Index interface {
+	List() []storage.FilesInfo
+	GetFile(fileName string) (storage.FilesInfo, bool)
+}
+
+// Server is a local HTTP/JSON API to control a running scanner.
+type Server struct {
+	scanner  scanner.FileScanner
+	index    Index
+	shutdown func()
+	logger   *logrus.Entry
+}
+
+// NewServer returns an API for fileScanner. shutdown is called to stop the
+// process once the scanner is drained.
+func NewServer(fileScanner scanner.FileScanner, index Index, shutdown func(), logger *logrus.Entry) *Server {
+	return &Server{
+		scanner:  fileScanner,
+		index:    index,
+		shutdown: shutdown,
+		logger:   logger,
+	}
+}
+
+// Listen listens on a unix socket if addr starts with unix:, on a TCP
+// address otherwise. The API has no authentication, so TCP addresses must
+// be loopback ones. A socket file left by a previous run is removed.
+func Listen(addr string) (net.Listener, error) {
+	path := strings.TrimPrefix(addr, "unix:")
+	if path == addr {
+		if err := checkLoopback(addr); err != nil {
+			return nil, err
+		}
+		return net.Listen("tcp", addr)
+	}
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	return net.Listen("unix", path)
+}
+
+func checkLoopback(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("%v is not a loopback address, use localhost, 127.0.0.1 or a unix socket", addr)
+	}
+	return nil
+}
+
+// Serve serves the API on listener until ctx is done.
+func (s *Server) Serve(ctx context.Context, listener net.Listener) error {
+	server := &http.Server{Handler: s.Handler()}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", only(http.MethodGet, s.status))
+	mux.HandleFunc("/files", only(http.MethodGet, s.files))
+	mux.HandleFunc("/file", only(http.MethodGet, s.file))
+	mux.HandleFunc("/scan", only(http.MethodPost, s.scan))
+	mux.HandleFunc("/pause", only(http.MethodPost, s.pause))
+	mux.HandleFunc("/resume", only(http.MethodPost, s.resume))
+	mux.HandleFunc("/shutdown", only(http.MethodPost, s.drain))
+	mux.HandleFunc("/acknowledge", only(http.MethodPost, s.acknowledge))
+	return mux
+}
+
+type statusResponse struct {
+	Paused bool           `json:"paused"`
+	Files  map[string]int `json:"files"`
+	// DeletesHeld is why deletions are held until acknowledged.
+	DeletesHeld string `json:"deletesHeld,omitempty"`
+}
+
+func (s *Server) status(w http.ResponseWriter, r *http.Request) {
+	counts := map[string]int{}
+	for _, file := range s.index.List() {
+		counts[file.Status.String()]++
+	}
+	response := statusResponse{Paused: s.scanner.Paused(), Files: counts}
+	if err := s.scanner.DeletesHeld(); err != nil {
+		response.DeletesHeld = err.Error()
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// files lists the index, only files with the status given by the status
+// query parameter if it is set.
+func (s *Server) files(w http.ResponseWriter, r *http.Request) {
+	files := s.index.List()
+	if name := r.URL.Query().Get("status"); name != "" {
+		status, err := storage.ParseStatus(name)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		filtered := files[:0]
+		for _, file := range files {
+			if file.Status == status {
+				filtered = append(filtered, file)
+			}
+		}
+		files = filtered
+	}
+	writeJSON(w, http.StatusOK, files)
+}
+
+func (s *Server) file(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	file, ok := s.index.GetFile(name)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("file %v is not in the index", name))
+		return
+	}
+	writeJSON(w, http.StatusOK, file)
+}
+
+func (s *Server) scan(w http.ResponseWriter, r *http.Request) {
+	if s.scanner.Paused() {
+		writeError(w, http.StatusConflict, errors.New("syncing is paused"))
+		return
+	}
+	s.scanner.ScanNow()
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "scan requested"})
+}
+
+func (s *Server) pause(w http.ResponseWriter, r *http.Request) {
+	s.scanner.Pause()
+	writeJSON(w, http.StatusOK, map[string]bool{"paused": true})
+}
+
+func (s *Server) resume(w http.ResponseWriter, r *http.Request) {
+	s.scanner.Resume()
+	writeJSON(w, http.StatusOK, map[string]bool{"paused": false})
+}
+
+// acknowledge lets the deletions held by the deletion guard run.
+func (s *Server) acknowledge(w http.ResponseWriter, r *http.Request) {
+	if s.scanner.DeletesHeld() == nil {
+		writeError(w, http.StatusConflict, errors.New("no deletions are held"))
+		return
+	}
+	s.scanner.AcknowledgeDeletes()
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "deletions acknowledged"})
+}
+
+// drain answers right away, as copying the queued files may take long, and
+// shuts down once they are copied.
+func (s *Server) drain(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "draining"})
+	go func() {
+		if err := s.scanner.Drain(); err != nil {
+			s.logger.Warnf("Drain interrupted: %v", err)
+		}
+		s.logger.Infof("Shutting down on API request")
+		s.shutdown()
+	}()
+}
+
+func only(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %v is not allowed", r.Method))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
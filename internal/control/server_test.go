@@ -0,0 +1,132 @@
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync_dir/internal/storage"
+	"testing"
+)
+
+var logger = logrus.NewEntry(logrus.New())
+
+// fakeScanner records the control calls made by the server.
+type fakeScanner struct {
+	paused  bool
+	scans   int
+	held    error
+	acked   bool
+	drained chan struct{}
+}
+
+func (f *fakeScanner) Run()                           {}
+func (f *fakeScanner) Wait()                          {}
+func (f *fakeScanner) Close() error                   { return nil }
+func (f *fakeScanner) CopyFile(fileName string) error { return nil }
+func (f *fakeScanner) ScanDir() error                 { return nil }
+func (f *fakeScanner) Reconcile() error               { return nil }
+func (f *fakeScanner) SyncOnce() error                { return nil }
+func (f *fakeScanner) Verify(repair bool) ([]storage.Drift, error) {
+	return nil, nil
+}
+func (f *fakeScanner) ScanNow()            { f.scans++ }
+func (f *fakeScanner) Pause()              { f.paused = true }
+func (f *fakeScanner) Resume()             { f.paused = false }
+func (f *fakeScanner) Paused() bool        { return f.paused }
+func (f *fakeScanner) DeletesHeld() error  { return f.held }
+func (f *fakeScanner) AcknowledgeDeletes() { f.acked = true }
+func (f *fakeScanner) Drain() error {
+	close(f.drained)
+	return nil
+}
+
+func TestServer(t *testing.T) {
+	index := storage.NewFileStorage(map[string]storage.FilesInfo{
+		"a.txt":   {FileName: "a.txt", Status: storage.Sync},
+		"b/c.txt": {FileName: "b/c.txt", Status: storage.Failed, Attempts: 2},
+	}, logger)
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		paused   bool
+		held     error
+		wantCode int
+		wantBody string
+		want     func(f *fakeScanner) bool
+	}{
+		{name: "status", method: "GET", target: "/status", paused: true, wantCode: 200, wantBody: `{"paused":true,"files":{"failed":1,"synced":1}}`},
+		{name: "status with held deletions", method: "GET", target: "/status", held: errors.New("directory /src is empty"), wantCode: 200, wantBody: `"deletesHeld":"directory /src is empty"`},
+		{name: "files by status", method: "GET", target: "/files?status=failed", wantCode: 200, wantBody: `"FileName":"b/c.txt"`},
+		{name: "unknown status", method: "GET", target: "/files?status=lost", wantCode: 400, wantBody: "unknown status"},
+		{name: "file", method: "GET", target: "/file?name=b/c.txt", wantCode: 200, wantBody: `"Attempts":2`},
+		{name: "missing file", method: "GET", target: "/file?name=d.txt", wantCode: 404, wantBody: "not in the index"},
+		{name: "scan", method: "POST", target: "/scan", wantCode: 202, want: func(f *fakeScanner) bool { return f.scans == 1 }},
+		{name: "scan while paused", method: "POST", target: "/scan", paused: true, wantCode: 409, want: func(f *fakeScanner) bool { return f.scans == 0 }},
+		{name: "scan with GET", method: "GET", target: "/scan", wantCode: 405},
+		{name: "pause", method: "POST", target: "/pause", wantCode: 200, want: func(f *fakeScanner) bool { return f.paused }},
+		{name: "resume", method: "POST", target: "/resume", paused: true, wantCode: 200, want: func(f *fakeScanner) bool { return !f.paused }},
+		{name: "acknowledge", method: "POST", target: "/acknowledge", held: errors.New("directory /src is empty"), wantCode: 202, want: func(f *fakeScanner) bool { return f.acked }},
+		{name: "acknowledge without held deletions", method: "POST", target: "/acknowledge", wantCode: 409, want: func(f *fakeScanner) bool { return !f.acked }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeScanner{paused: tt.paused, held: tt.held}
+			recorder := httptest.NewRecorder()
+			NewServer(f, index, func() {}, logger).Handler().ServeHTTP(recorder, httptest.NewRequest(tt.method, tt.target, nil))
+			if recorder.Code != tt.wantCode {
+				t.Errorf("%v %v code = %v, want %v", tt.method, tt.target, recorder.Code, tt.wantCode)
+			}
+			if !strings.Contains(recorder.Body.String(), tt.wantBody) {
+				t.Errorf("%v %v body = %v, want %v", tt.method, tt.target, recorder.Body.String(), tt.wantBody)
+			}
+			if tt.want != nil && !tt.want(f) {
+				t.Errorf("%v %v scanner state = %+v", tt.method, tt.target, f)
+			}
+		})
+	}
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	f := &fakeScanner{drained: make(chan struct{})}
+	shutdown := make(chan struct{})
+	server := NewServer(f, storage.NewFileStorage(map[string]storage.FilesInfo{}, logger), func() { close(shutdown) }, logger)
+	recorder := httptest.NewRecorder()
+	server.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/shutdown", nil))
+	var body map[string]string
+	if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil || body["status"] != "draining" {
+		t.Errorf("/shutdown body = %v, error = %v", recorder.Body.String(), err)
+	}
+	<-f.drained
+	<-shutdown
+}
+
+func TestListen(t *testing.T) {
+	tests := []struct {
+		name    string
+		addr    string
+		wantErr bool
+	}{
+		{name: "loopback", addr: "127.0.0.1:0"},
+		{name: "localhost", addr: "localhost:0"},
+		{name: "unix socket", addr: "unix:" + filepath.Join(t.TempDir(), "control.sock")},
+		{name: "all interfaces", addr: ":0", wantErr: true},
+		{name: "unspecified", addr: "0.0.0.0:0", wantErr: true},
+		{name: "remote host", addr: "example.com:8080", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listener, err := Listen(tt.addr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Listen(%v) error = %v, wantErr %v", tt.addr, err, tt.wantErr)
+			}
+			if listener != nil {
+				listener.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package ignore
+
+import (
+	"bufio"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// FileName is the name of files with ignore rules picked up while walking.
+const FileName = ".syncignore"
+
+type rule struct {
+	re      *regexp.Regexp
+	base    string
+	negate  bool
+	dirOnly bool
+}
+
+// Matcher decides which paths are excluded using gitignore rules. Paths are
+// relative to the scanned root and use forward slashes. Rules added later
+// take precedence, so rules of nested directories have to be added after
+// the rules of their parents.
+type Matcher struct {
+	rules []rule
+}
+
+func NewMatcher(patterns []string) *Matcher {
+	m := &Matcher{}
+	m.AddPatterns("", patterns)
+	return m
+}
+
+// AddPatterns adds rules that apply to paths under the base directory.
+func (m *Matcher) AddPatterns(base string, patterns []string) {
+	if base == "." {
+		base = ""
+	}
+	for _, pattern := range patterns {
+		if r, ok := compile(pattern); ok {
+			r.base = base
+			m.rules = append(m.rules, r)
+		}
+	}
+}
+
+// AddFile adds rules from the ignore file at filePath. They apply to paths
+// under the base directory. A missing file is not an error.
+func (m *Matcher) AddFile(base, filePath string) error {
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var patterns []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		patterns = append(patterns, scanner.Text())
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	m.AddPatterns(base, patterns)
+	return nil
+}
+
+// Match reports whether name is excluded. The last matching rule wins.
+func (m *Matcher) Match(name string, isDir bool) bool {
+	excluded := false
+	for _, r := range m.rules {
+		rel := name
+		if r.base != "" {
+			if !strings.HasPrefix(name, r.base+"/") {
+				continue
+			}
+			rel = strings.TrimPrefix(name, r.base+"/")
+		}
+		if r.dirOnly && !isDir {
+			continue
+		}
+		if r.re.MatchString(rel) {
+			excluded = !r.negate
+		}
+	}
+	return excluded
+}
+
+// Escape quotes the glob characters of a path, so a pattern made of it
+// matches only that path.
+func Escape(path string) string {
+	var escaped strings.Builder
+	for _, c := range path {
+		if strings.ContainsRune(`*?[\`, c) {
+			escaped.WriteRune('\\')
+		}
+		escaped.WriteRune(c)
+	}
+	return escaped.String()
+}
+
+func compile(pattern string) (rule, bool) {
+	pattern = strings.TrimRight(pattern, " ")
+	if pattern == "" || strings.HasPrefix(pattern, "#") {
+		return rule{}, false
+	}
+	var r rule
+	if strings.HasPrefix(pattern, "!") {
+		r.negate = true
+		pattern = pattern[1:]
+	} else if strings.HasPrefix(pattern, `\`) {
+		pattern = pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "/") {
+		r.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	if pattern == "" {
+		return rule{}, false
+	}
+	anchored := strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+	expr := toRegexp(pattern)
+	if !anchored {
+		expr = "(?:.*/)?" + expr
+	}
+	re, err := regexp.Compile("^" + expr + "$")
+	if err != nil {
+		return rule{}, false
+	}
+	r.re = re
+	return r, true
+}
+
+// toRegexp converts a gitignore glob to a regular expression. "**" matches
+// any number of directories, "*" and "?" never match a slash.
+func toRegexp(pattern string) string {
+	var expr strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			expr.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "/**") && i+3 == len(pattern):
+			expr.WriteString("/.*")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			expr.WriteString(".*")
+			i++
+		case c == '*':
+			expr.WriteString("[^/]*")
+		case c == '?':
+			expr.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				expr.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			expr.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return expr.String()
+}
@@ -0,0 +1,80 @@
+package ignore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMatcher_Match(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		path     string
+		isDir    bool
+		want     bool
+	}{
+		{name: "extension at any depth", patterns: []string{"*.tmp"}, path: "a/b/1.tmp", want: true},
+		{name: "extension does not match other files", patterns: []string{"*.tmp"}, path: "a/1.txt", want: false},
+		{name: "comment and blank line", patterns: []string{"# *.txt", ""}, path: "1.txt", want: false},
+		{name: "negation", patterns: []string{"*.log", "!keep.log"}, path: "a/keep.log", want: false},
+		{name: "negation order", patterns: []string{"!keep.log", "*.log"}, path: "keep.log", want: true},
+		{name: "directory only matches directory", patterns: []string{"build/"}, path: "a/build", isDir: true, want: true},
+		{name: "directory only skips file", patterns: []string{"build/"}, path: "a/build", want: false},
+		{name: "anchored pattern", patterns: []string{"/todo.txt"}, path: "todo.txt", want: true},
+		{name: "anchored pattern not nested", patterns: []string{"/todo.txt"}, path: "a/todo.txt", want: false},
+		{name: "pattern with slash is anchored", patterns: []string{"doc/*.md"}, path: "a/doc/1.md", want: false},
+		{name: "leading double star", patterns: []string{"**/cache"}, path: "a/b/cache", isDir: true, want: true},
+		{name: "trailing double star", patterns: []string{"logs/**"}, path: "logs/a/1.log", want: true},
+		{name: "middle double star", patterns: []string{"a/**/z.txt"}, path: "a/b/c/z.txt", want: true},
+		{name: "middle double star no dirs", patterns: []string{"a/**/z.txt"}, path: "a/z.txt", want: true},
+		{name: "star does not cross slash", patterns: []string{"a/*.txt"}, path: "a/b/1.txt", want: false},
+		{name: "question mark", patterns: []string{"?.swp"}, path: ".swp", want: false},
+		{name: "character class", patterns: []string{"*.sw[op]"}, path: ".main.go.swp", want: true},
+		{name: "negated character class", patterns: []string{"[!a]*.txt"}, path: "abc.txt", want: false},
+		{name: "escaped negation", patterns: []string{`\!important`}, path: "!important", want: true},
+		{name: "escaped path", patterns: []string{"/" + Escape("out[1]?*") + "/"}, path: "out[1]?*", isDir: true, want: true},
+		{name: "escaped path is not a glob", patterns: []string{"/" + Escape("out[1]?*") + "/"}, path: "out1x", isDir: true, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NewMatcher(tt.patterns).Match(tt.path, tt.isDir); got != tt.want {
+				t.Errorf("Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatcher_AddFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, FileName), []byte("*.txt\n!keep.txt\n/local\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m := NewMatcher([]string{"*.log"})
+	if err := m.AddFile("a", filepath.Join(dir, FileName)); err != nil {
+		t.Fatalf("AddFile() error = %v", err)
+	}
+	if err := m.AddFile("b", filepath.Join(dir, "missing")); err != nil {
+		t.Fatalf("AddFile() missing file error = %v", err)
+	}
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{path: "a/1.txt", want: true},
+		{path: "a/b/1.txt", want: true},
+		{path: "a/keep.txt", want: false},
+		{path: "1.txt", want: false},
+		{path: "b/1.txt", want: false},
+		{path: "a/local", want: true},
+		{path: "a/b/local", want: false},
+		{path: "b/1.log", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := m.Match(tt.path, false); got != tt.want {
+				t.Errorf("Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
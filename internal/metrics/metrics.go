@@ -0,0 +1,177 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"time"
+)
+
+const namespace = "sync_dir"
+
+// Metrics holds the collectors filled by FileScannerWithMetrics and
+// StorageWithMetrics and served by Handler.
+type Metrics struct {
+	registry *prometheus.Registry
+	// registerer adds the collectors of a job to registry.
+	registerer   prometheus.Registerer
+	filesCopied  prometheus.Counter
+	filesFailed  prometheus.Counter
+	scanDuration *prometheus.HistogramVec
+	copyDuration prometheus.Histogram
+}
+
+// New returns the metrics of a single sync job.
+func New() *Metrics {
+	registry := newRegistry()
+	return newMetrics(registry, registry)
+}
+
+// Jobs serves the metrics of the sync jobs of one process, labelled with
+// the job name as sync_job, since Prometheus sets job to the scrape target.
+type Jobs struct {
+	registry *prometheus.Registry
+}
+
+func NewJobs() *Jobs {
+	return &Jobs{registry: newRegistry()}
+}
+
+// Job returns the metrics of the job name. Every job needs a unique name.
+func (j *Jobs) Job(name string) *Metrics {
+	return newMetrics(j.registry, prometheus.WrapRegistererWith(prometheus.Labels{"sync_job": name}, j.registry))
+}
+
+// Handler serves the metrics of all jobs in the Prometheus text format.
+func (j *Jobs) Handler() http.Handler {
+	return promhttp.HandlerFor(j.registry, promhttp.HandlerOpts{})
+}
+
+func newRegistry() *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	return registry
+}
+
+func newMetrics(registry *prometheus.Registry, registerer prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		registry:   registry,
+		registerer: registerer,
+		filesCopied: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "files_copied_total",
+			Help:      "Files copied to the destination directory.",
+		}),
+		filesFailed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "files_failed_total",
+			Help:      "Failed attempts to sync a file.",
+		}),
+		scanDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "scan_duration_seconds",
+			Help:      "Duration of scans and reconciles of the source directory.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 4, 10),
+		}, []string{"kind"}),
+		copyDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "copy_duration_seconds",
+			Help:      "Duration of file copies.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+		}),
+	}
+	m.registerer.MustRegister(
+		m.filesCopied, m.filesFailed, m.scanDuration, m.copyDuration)
+	return m
+}
+
+// Scanned exports the number of scanned source files, see
+// scanner.DirScanner.Scanned.
+func (m *Metrics) Scanned(scanned func() int64) {
+	m.registerer.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "files_scanned_total",
+		Help:      "Source files seen by scans.",
+	}, func() float64 { return float64(scanned()) }))
+}
+
+// observe records a call of a method of the wrapped FileScanner or Storage,
+// see internal/wrappers/templates/metrics.
+func (m *Metrics) observe(method string, since time.Time, err error) {
+	switch method {
+	case "FileScanner.CopyFile":
+		m.copyDuration.Observe(time.Since(since).Seconds())
+		if err == nil {
+			m.filesCopied.Inc()
+		}
+	case "FileScanner.ScanDir":
+		m.scanDuration.WithLabelValues("scan").Observe(time.Since(since).Seconds())
+	case "FileScanner.Reconcile":
+		m.scanDuration.WithLabelValues("reconcile").Observe(time.Since(since).Seconds())
+	case "Storage.MarkFailed":
+		m.filesFailed.Inc()
+	}
+}
+
+// FilesDeleted exports the number of files deleted from the destination, see
+// storage.Files.Deleted.
+func (m *Metrics) FilesDeleted(deleted func() int64) {
+	m.registerer.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "files_deleted_total",
+		Help:      "Files deleted from the destination directory after they were removed from the source.",
+	}, func() float64 { return float64(deleted()) }))
+}
+
+// BytesCopied exports the number of bytes written by copies, see
+// scanner.DirScanner.Written.
+func (m *Metrics) BytesCopied(written func() int64) {
+	m.registerer.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bytes_copied_total",
+		Help:      "Bytes written to the destination directory by copies.",
+	}, func() float64 { return float64(written()) }))
+}
+
+// Queue exports the number of file names waiting in queue.
+func (m *Metrics) Queue(name string, queue chan string) {
+	m.registerer.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Name:        "queue_depth",
+		Help:        "File names waiting in a queue of the scanner.",
+		ConstLabels: prometheus.Labels{"queue": name},
+	}, func() float64 { return float64(len(queue)) }))
+}
+
+// IndexSize exports the number of files in the index.
+func (m *Metrics) IndexSize(size func() int) {
+	m.registerer.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "index_files",
+		Help:      "Files in the index.",
+	}, func() float64 { return float64(size()) }))
+}
+
+// DeletesHeld exports 1 while the deletion guard holds deletions, see
+// scanner.DirScanner.DeletesHeld.
+func (m *Metrics) DeletesHeld(held func() error) {
+	m.registerer.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "deletes_held",
+		Help:      "Whether deletions of files missing in the source are held until acknowledged.",
+	}, func() float64 {
+		if held() != nil {
+			return 1
+		}
+		return 0
+	}))
+}
+
+// Handler serves the metrics in the Prometheus text format, together with
+// the metrics of the other jobs if m belongs to Jobs.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,146 @@
+package metrics
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync_dir/internal/storage"
+	"testing"
+	"time"
+)
+
+var logger = logrus.NewEntry(logrus.New())
+
+// fakeScanner copies nothing, its methods fail with err.
+type fakeScanner struct {
+	err error
+}
+
+func (f fakeScanner) Run()                           {}
+func (f fakeScanner) Wait()                          {}
+func (f fakeScanner) Close() error                   { return nil }
+func (f fakeScanner) CopyFile(fileName string) error { return f.err }
+func (f fakeScanner) ScanDir() error                 { return f.err }
+func (f fakeScanner) Reconcile() error               { return f.err }
+func (f fakeScanner) SyncOnce() error                { return f.err }
+func (f fakeScanner) Verify(repair bool) ([]storage.Drift, error) {
+	return nil, f.err
+}
+func (f fakeScanner) ScanNow()            {}
+func (f fakeScanner) Pause()              {}
+func (f fakeScanner) Resume()             {}
+func (f fakeScanner) Paused() bool        { return false }
+func (f fakeScanner) Drain() error        { return nil }
+func (f fakeScanner) DeletesHeld() error  { return nil }
+func (f fakeScanner) AcknowledgeDeletes() {}
+
+func TestFileScannerWithMetrics(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantCopied float64
+	}{
+		{name: "copied", wantCopied: 2},
+		{name: "failed", err: errors.New("no space left")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := New()
+			wrapped := NewFileScannerWithMetrics(fakeScanner{err: tt.err}, m)
+			for _, fileName := range []string{"a.txt", "b.txt"} {
+				if err := wrapped.CopyFile(fileName); !errors.Is(err, tt.err) {
+					t.Errorf("CopyFile() error = %v, want %v", err, tt.err)
+				}
+			}
+			wrapped.ScanDir()
+			wrapped.Reconcile()
+			if got := testutil.ToFloat64(m.filesCopied); got != tt.wantCopied {
+				t.Errorf("files copied = %v, want %v", got, tt.wantCopied)
+			}
+			if got := testutil.CollectAndCount(m.copyDuration); got != 1 {
+				t.Errorf("copy duration histograms = %v, want 1", got)
+			}
+			if got := testutil.CollectAndCount(m.scanDuration); got != 2 {
+				t.Errorf("scan duration histograms = %v, want 2", got)
+			}
+		})
+	}
+}
+
+func TestStorageWithMetrics(t *testing.T) {
+	srcDir, destDir := t.TempDir(), t.TempDir()
+	files := map[string]storage.FilesInfo{}
+	for _, fileName := range []string{"kept.txt", "removed.txt"} {
+		files[fileName] = storage.FilesInfo{FileName: fileName, FilePath: filepath.Join(srcDir, fileName), Status: storage.Sync}
+		if err := os.WriteFile(filepath.Join(destDir, fileName), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(srcDir, "kept.txt"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	m := New()
+	fileStorage := storage.NewFileStorage(files, logger)
+	m.IndexSize(fileStorage.Len)
+	m.FilesDeleted(fileStorage.Deleted)
+	wrapped := NewStorageWithMetrics(fileStorage, m)
+	wrapped.MarkFailed(files["kept.txt"], errors.New("permission denied"), time.Now())
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	if err := wrapped.CheckIfExistAndRemove(destDir, wg); err != nil {
+		t.Fatalf("CheckIfExistAndRemove() error = %v", err)
+	}
+	if got := testutil.ToFloat64(m.filesFailed); got != 1 {
+		t.Errorf("files failed = %v, want 1", got)
+	}
+
+	queue := make(chan string, 5)
+	queue <- "kept.txt"
+	m.Queue("filesToSync", queue)
+	m.Scanned(func() int64 { return 7 })
+	m.BytesCopied(func() int64 { return 1024 })
+	m.DeletesHeld(func() error { return errors.New("source directory is empty") })
+	recorder := httptest.NewRecorder()
+	m.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		"sync_dir_index_files 1",
+		`sync_dir_queue_depth{queue="filesToSync"} 1`,
+		"sync_dir_files_scanned_total 7",
+		"sync_dir_files_deleted_total 1",
+		"sync_dir_bytes_copied_total 1024",
+		"sync_dir_deletes_held 1",
+	} {
+		if !strings.Contains(recorder.Body.String(), want) {
+			t.Errorf("/metrics has no %q", want)
+		}
+	}
+}
+
+func TestJobs(t *testing.T) {
+	jobs := NewJobs()
+	for i, name := range []string{"photos", "documents"} {
+		m := jobs.Job(name)
+		for j := 0; j <= i; j++ {
+			m.filesCopied.Inc()
+		}
+		m.Queue("filesToSync", make(chan string, 5))
+		m.IndexSize(func() int { return 3 })
+	}
+	recorder := httptest.NewRecorder()
+	jobs.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		`sync_dir_files_copied_total{sync_job="photos"} 1`,
+		`sync_dir_files_copied_total{sync_job="documents"} 2`,
+		`sync_dir_queue_depth{queue="filesToSync",sync_job="documents"} 0`,
+		`sync_dir_index_files{sync_job="photos"} 3`,
+	} {
+		if !strings.Contains(recorder.Body.String(), want) {
+			t.Errorf("/metrics has no %q", want)
+		}
+	}
+}
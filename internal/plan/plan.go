@@ -0,0 +1,158 @@
+package plan
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"sync_dir/internal/utils"
+	"text/tabwriter"
+	"time"
+)
+
+type Action string
+
+const (
+	Copy     Action = "copy"
+	Update   Action = "update"
+	Metadata Action = "metadata"
+	Delete   Action = "delete"
+	// Move renames the destination copy of a file moved in the source.
+	Move Action = "move"
+)
+
+type Item struct {
+	Action     Action `json:"action"`
+	FileName   string `json:"file"`
+	Size       int64  `json:"size,omitempty"`
+	Hash       string `json:"hash,omitempty"`
+	HashAlgo   string `json:"hashAlgo,omitempty"`
+	LinkTarget string `json:"linkTarget,omitempty"`
+	HardlinkOf string `json:"hardlinkOf,omitempty"`
+	// From is the old name of a moved file.
+	From string `json:"from,omitempty"`
+}
+
+// Changed reports whether the source file src no longer is what the plan
+// saw, so the item must not be applied.
+func (item Item) Changed(src string) (bool, error) {
+	if item.LinkTarget != "" {
+		target, err := os.Readlink(src)
+		return target != item.LinkTarget, err
+	}
+	if item.Hash == "" || item.HardlinkOf != "" {
+		return false, nil
+	}
+	hasher, err := utils.NewHasher(item.HashAlgo)
+	if err != nil {
+		return false, err
+	}
+	hash, err := hasher.Sum(src)
+	return hash != item.Hash, err
+}
+
+// Plan lists what a sync pass would change in the destination directory.
+type Plan struct {
+	sync.Mutex `json:"-"`
+	SourceDir  string    `json:"sourceDir"`
+	DestDir    string    `json:"destDir"`
+	Created    time.Time `json:"created"`
+	Items      []Item    `json:"items"`
+}
+
+func New(sourceDir, destDir string) *Plan {
+	return &Plan{
+		SourceDir: sourceDir,
+		DestDir:   destDir,
+		Created:   time.Now(),
+		Items:     []Item{},
+	}
+}
+
+func (p *Plan) Add(item Item) {
+	p.Lock()
+	defer p.Unlock()
+	p.Items = append(p.Items, item)
+}
+
+// Sort orders items by file name, deletions go last.
+func (p *Plan) Sort() {
+	p.Lock()
+	defer p.Unlock()
+	sort.SliceStable(p.Items, func(i, j int) bool {
+		if (p.Items[i].Action == Delete) != (p.Items[j].Action == Delete) {
+			return p.Items[j].Action == Delete
+		}
+		return p.Items[i].FileName < p.Items[j].FileName
+	})
+}
+
+func (p *Plan) Count(action Action) int {
+	p.Lock()
+	defer p.Unlock()
+	count := 0
+	for _, item := range p.Items {
+		if item.Action == action {
+			count++
+		}
+	}
+	return count
+}
+
+func (p *Plan) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "ACTION\tFILE\tSIZE\n")
+	p.Lock()
+	for _, item := range p.Items {
+		name := item.FileName
+		if item.LinkTarget != "" {
+			name += " -> " + item.LinkTarget
+		} else if item.HardlinkOf != "" {
+			name += " => " + item.HardlinkOf
+		} else if item.From != "" {
+			name += " <- " + item.From
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\n", item.Action, name, item.Size)
+	}
+	p.Unlock()
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%v to copy, %v to update, %v metadata changes, %v to delete, %v to move\n",
+		p.Count(Copy), p.Count(Update), p.Count(Metadata), p.Count(Delete), p.Count(Move))
+	return err
+}
+
+func (p *Plan) WriteJSON(w io.Writer) error {
+	p.Lock()
+	defer p.Unlock()
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(p)
+}
+
+func (p *Plan) Save(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err = p.WriteJSON(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func Load(path string) (*Plan, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &Plan{}
+	if err = json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("error reading plan %v: %v", path, err)
+	}
+	return p, nil
+}
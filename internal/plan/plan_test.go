@@ -0,0 +1,81 @@
+package plan
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync_dir/internal/utils"
+	"testing"
+)
+
+func TestPlan_SaveLoad(t *testing.T) {
+	p := New("/src", "/dst")
+	p.Add(Item{Action: Delete, FileName: "0.txt"})
+	p.Add(Item{Action: Copy, FileName: "b/1.txt", Size: 10, Hash: "abc", HashAlgo: "md5"})
+	p.Add(Item{Action: Update, FileName: "a.txt", Size: 5})
+	p.Sort()
+	path := filepath.Join(t.TempDir(), "plan.json")
+	if err := p.Save(path); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	got, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	want := []string{"a.txt", "b/1.txt", "0.txt"}
+	for i, item := range got.Items {
+		if item.FileName != want[i] {
+			t.Errorf("Items[%v] = %v, want %v", i, item.FileName, want[i])
+		}
+	}
+	var table bytes.Buffer
+	if err = got.WriteTable(&table); err != nil {
+		t.Fatalf("WriteTable() error = %v", err)
+	}
+	if !strings.Contains(table.String(), "1 to copy, 1 to update, 0 metadata changes, 1 to delete") {
+		t.Errorf("WriteTable() = %v", table.String())
+	}
+}
+
+func TestItem_Changed(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "1.txt")
+	if err := os.WriteFile(src, []byte("1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink("1.txt", link); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := utils.DefaultHasher().Sum(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		item    Item
+		src     string
+		want    bool
+		wantErr bool
+	}{
+		{name: "same hash", item: Item{Hash: hash, HashAlgo: "md5"}, src: src},
+		{name: "other hash", item: Item{Hash: "planned", HashAlgo: "md5"}, src: src, want: true},
+		{name: "no hash", item: Item{}, src: src},
+		{name: "hard link", item: Item{Hash: "planned", HardlinkOf: "0.txt"}, src: src},
+		{name: "same link target", item: Item{LinkTarget: "1.txt"}, src: link},
+		{name: "other link target", item: Item{LinkTarget: "2.txt"}, src: link, want: true},
+		{name: "missing source", item: Item{Hash: hash, HashAlgo: "md5"}, src: filepath.Join(dir, "2.txt"), want: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.item.Changed(tt.src)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Changed() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("Changed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
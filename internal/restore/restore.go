@@ -0,0 +1,144 @@
+package restore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync_dir/internal/storage"
+	"sync_dir/internal/utils"
+	"sync_dir/internal/versions"
+	"time"
+)
+
+// Index is the part of the storage current destination files are read from.
+type Index interface {
+	List() []storage.FilesInfo
+}
+
+// Entry is a copy of a file that can be restored: a kept version or the
+// current destination file.
+type Entry struct {
+	// FileName is the path of the file relative to the destination directory.
+	FileName string
+	// Path is where the copy is stored.
+	Path string
+	// Time is when the version was replaced or deleted, zero for the
+	// current file.
+	Time time.Time
+	// Modified is when the content of the copy was last modified.
+	Modified time.Time
+	Size     int64
+}
+
+func (e Entry) Current() bool {
+	return e.Time.IsZero()
+}
+
+type Restorer struct {
+	destDir  string
+	store    *versions.Store
+	index    Index
+	preserve utils.Preserve
+}
+
+func New(destDir string, store *versions.Store, index Index, preserve utils.Preserve) *Restorer {
+	return &Restorer{destDir: destDir, store: store, index: index, preserve: preserve}
+}
+
+// under reports whether fileName is path or lies inside it. An empty path
+// or . matches everything.
+func under(fileName, path string) bool {
+	path = filepath.Clean(path)
+	return path == "." || fileName == path || strings.HasPrefix(fileName, path+string(filepath.Separator))
+}
+
+// List returns the current copies and the versions of the files under
+// path, sorted by file name, the current copy first and the newest versions
+// next.
+func (r *Restorer) List(path string) ([]Entry, error) {
+	var entries []Entry
+	for _, file := range r.index.List() {
+		if !under(file.FileName, path) {
+			continue
+		}
+		dst := filepath.Join(r.destDir, file.FileName)
+		if info, err := os.Lstat(dst); err == nil {
+			entries = append(entries, Entry{FileName: file.FileName, Path: dst, Modified: file.LastModified, Size: info.Size()})
+		}
+	}
+	all, err := r.store.All()
+	if err != nil {
+		return nil, err
+	}
+	for _, version := range all {
+		if !under(version.FileName, path) {
+			continue
+		}
+		entry := Entry{FileName: version.FileName, Path: version.Path, Time: version.Time, Size: version.Size}
+		if info, err := os.Lstat(version.Path); err == nil {
+			entry.Modified = info.ModTime()
+		}
+		entries = append(entries, entry)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].FileName != entries[j].FileName {
+			return entries[i].FileName < entries[j].FileName
+		}
+		return entries[i].Current() || !entries[j].Current() && entries[i].Time.After(entries[j].Time)
+	})
+	return entries, nil
+}
+
+// At returns the copies of the files under path as they were at t. A file
+// had the content of its oldest version replaced after t, or the current
+// content if none was. A copy modified after t did not exist yet, so files
+// created after t are left out.
+func (r *Restorer) At(path string, t time.Time) ([]Entry, error) {
+	entries, err := r.List(path)
+	if err != nil {
+		return nil, err
+	}
+	chosen := map[string]Entry{}
+	for _, entry := range entries {
+		if !entry.Current() && !entry.Time.After(t) {
+			continue
+		}
+		// Entries come current first and then from the newest version, so
+		// every next one that fits is older.
+		chosen[entry.FileName] = entry
+	}
+	var result []Entry
+	for _, entry := range chosen {
+		if !entry.Modified.After(t) {
+			result = append(result, entry)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].FileName < result[j].FileName
+	})
+	return result, nil
+}
+
+// Restore copies entry to the same relative path in dir. A destination file
+// it replaces is kept as a version first. Restoring the current copy into
+// the destination directory does nothing.
+func (r *Restorer) Restore(entry Entry, dir string) error {
+	dst := filepath.Join(dir, entry.FileName)
+	if utils.SameFile(entry.Path, dst) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if filepath.Clean(dir) == filepath.Clean(r.destDir) {
+		if err := r.store.Save(entry.FileName); err != nil {
+			return err
+		}
+	}
+	if err := utils.CopyFilesWithIoCopy(entry.Path, dst, r.preserve); err != nil {
+		return fmt.Errorf("error restoring %v: %v", entry.FileName, err)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package restore
+
+import (
+	"github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"sync_dir/internal/storage"
+	"sync_dir/internal/utils"
+	"sync_dir/internal/versions"
+	"testing"
+	"time"
+)
+
+var logger = logrus.NewEntry(logrus.New())
+
+var base = time.Date(2026, 10, 18, 8, 0, 0, 0, time.UTC)
+
+func writeFile(t *testing.T, path, content string, modified time.Time) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// history sets up a destination where d/f.txt was "v1" from 8:00 and "v2"
+// from 10:00, d/g.txt existed from 8:00 until it was deleted at 11:00 and
+// h.txt was created at 12:00.
+func history(t *testing.T) (string, *Restorer) {
+	destDir := t.TempDir()
+	store := versions.NewStore(destDir, versions.Policy{})
+	versionPath := func(fileName string, replaced time.Time) string {
+		return filepath.Join(destDir, versions.DirName, fileName+"~"+replaced.Format("20060102T150405.000000000Z"))
+	}
+	writeFile(t, versionPath("d/f.txt", base.Add(2*time.Hour)), "v1", base)
+	writeFile(t, filepath.Join(destDir, "d", "f.txt"), "v2", base.Add(2*time.Hour))
+	writeFile(t, versionPath("d/g.txt", base.Add(3*time.Hour)), "g", base)
+	writeFile(t, filepath.Join(destDir, "h.txt"), "h", base.Add(4*time.Hour))
+	index := storage.NewFileStorage(map[string]storage.FilesInfo{
+		"d/f.txt": {FileName: "d/f.txt", LastModified: base.Add(2 * time.Hour)},
+		"h.txt":   {FileName: "h.txt", LastModified: base.Add(4 * time.Hour)},
+	}, logger)
+	return destDir, New(destDir, store, index, utils.Preserve{Times: true})
+}
+
+func TestRestorer_List(t *testing.T) {
+	_, restorer := history(t)
+	entries, err := restorer.List("d")
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	want := []struct {
+		fileName string
+		current  bool
+	}{{"d/f.txt", true}, {"d/f.txt", false}, {"d/g.txt", false}}
+	if len(entries) != len(want) {
+		t.Fatalf("List() = %+v, want %v entries", entries, len(want))
+	}
+	for i, entry := range entries {
+		if entry.FileName != want[i].fileName || entry.Current() != want[i].current {
+			t.Errorf("List()[%v] = %+v, want %+v", i, entry, want[i])
+		}
+	}
+}
+
+func TestRestorer_At(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		at   time.Time
+		want map[string]string
+	}{
+		{name: "before everything", path: ".", at: base.Add(-time.Hour), want: map[string]string{}},
+		{name: "first versions", path: ".", at: base.Add(time.Hour), want: map[string]string{"d/f.txt": "v1", "d/g.txt": "g"}},
+		{name: "after update", path: ".", at: base.Add(150 * time.Minute), want: map[string]string{"d/f.txt": "v2", "d/g.txt": "g"}},
+		{name: "after delete", path: ".", at: base.Add(5 * time.Hour), want: map[string]string{"d/f.txt": "v2", "h.txt": "h"}},
+		{name: "subtree", path: "d", at: base.Add(time.Hour), want: map[string]string{"d/f.txt": "v1", "d/g.txt": "g"}},
+		{name: "single file", path: "d/g.txt", at: base.Add(time.Hour), want: map[string]string{"d/g.txt": "g"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, restorer := history(t)
+			entries, err := restorer.At(tt.path, tt.at)
+			if err != nil {
+				t.Fatalf("At() error = %v", err)
+			}
+			toDir := t.TempDir()
+			for _, entry := range entries {
+				if err = restorer.Restore(entry, toDir); err != nil {
+					t.Fatalf("Restore() error = %v", err)
+				}
+			}
+			if len(entries) != len(tt.want) {
+				t.Errorf("At() returned %v files, want %v", len(entries), len(tt.want))
+			}
+			for fileName, content := range tt.want {
+				if got, err := os.ReadFile(filepath.Join(toDir, fileName)); err != nil || string(got) != content {
+					t.Errorf("%v = %q, %v, want %q", fileName, got, err, content)
+				}
+			}
+		})
+	}
+}
+
+func TestRestorer_RestoreToDestination(t *testing.T) {
+	destDir, restorer := history(t)
+	entries, err := restorer.At("d/f.txt", base.Add(time.Hour))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("At() = %v, %v", entries, err)
+	}
+	if err = restorer.Restore(entries[0], destDir); err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(destDir, "d", "f.txt")); string(got) != "v1" {
+		t.Errorf("d/f.txt = %q, want v1", got)
+	}
+	// The replaced content is kept as a version, so the restore can be undone.
+	listed, err := restorer.List("d/f.txt")
+	if err != nil || len(listed) != 3 {
+		t.Errorf("List() = %+v, %v, want 3 entries", listed, err)
+	}
+}
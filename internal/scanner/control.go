@@ -0,0 +1,98 @@
+package scanner
+
+import (
+	"sync/atomic"
+)
+
+// ScanNow asks Run to scan the source directory right away. Requests made
+// while one is waiting are merged, requests made while paused are dropped.
+func (d *DirScanner) ScanNow() {
+	select {
+	case d.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Pause stops Run from starting scans and the workers from copying files
+// until Resume. Copies already started are finished.
+func (d *DirScanner) Pause() {
+	d.pauseMu.Lock()
+	defer d.pauseMu.Unlock()
+	if d.resumed == nil {
+		d.resumed = make(chan struct{})
+		d.logger.Infof("Syncing paused")
+	}
+}
+
+// Resume continues syncing and scans the source directory for the changes
+// missed while paused.
+func (d *DirScanner) Resume() {
+	if d.resume() {
+		d.logger.Infof("Syncing resumed")
+		d.ScanNow()
+	}
+}
+
+func (d *DirScanner) resume() bool {
+	d.pauseMu.Lock()
+	defer d.pauseMu.Unlock()
+	if d.resumed == nil {
+		return false
+	}
+	close(d.resumed)
+	d.resumed = nil
+	return true
+}
+
+func (d *DirScanner) Paused() bool {
+	d.pauseMu.Lock()
+	defer d.pauseMu.Unlock()
+	return d.resumed != nil
+}
+
+// waitResumed blocks while syncing is paused. It reports false if the
+// scanner is stopped meanwhile.
+func (d *DirScanner) waitResumed() bool {
+	d.pauseMu.Lock()
+	resumed := d.resumed
+	d.pauseMu.Unlock()
+	if resumed == nil {
+		return true
+	}
+	select {
+	case <-resumed:
+		return true
+	case <-d.ctx.Done():
+		return false
+	}
+}
+
+// held reports whether Run should leave new scans for later.
+func (d *DirScanner) held() bool {
+	return d.Paused() || atomic.LoadInt32(&d.draining) == 1
+}
+
+// Drain stops Run from starting new scans, resumes a paused scanner and
+// waits until running walks are finished and every queued file is copied.
+// Run keeps going, the caller is expected to stop it afterwards.
+func (d *DirScanner) Drain() error {
+	atomic.StoreInt32(&d.draining, 1)
+	d.resume()
+	d.logger.Infof("Draining scanner")
+	for atomic.LoadInt32(&d.walks) > 0 || atomic.LoadInt64(&d.pending) > 0 || len(d.syncDone) > 0 {
+		select {
+		case <-d.ctx.Done():
+			return d.ctx.Err()
+		case <-d.progress:
+		}
+	}
+	return nil
+}
+
+// progressed wakes Drain to check again whether everything is done.
+func (d *DirScanner) progressed() {
+	select {
+	case d.progress <- struct{}{}:
+	default:
+	}
+}
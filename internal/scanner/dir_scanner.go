@@ -2,19 +2,97 @@ package scanner
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"sync_dir/internal/ignore"
+	"sync_dir/internal/plan"
 	"sync_dir/internal/storage/generated_storage"
 
 	"sync_dir/internal/storage"
 	"sync_dir/internal/utils"
+	"sync_dir/internal/versions"
 	"time"
 )
 
+const debounceInterval = 500 * time.Millisecond
+
+// debounceMaxWait bounds how long a stream of events, like appends to a log
+// file, can delay a batch.
+const debounceMaxWait = 5 * time.Second
+
+// pruneInterval is how often scans apply the retention policy to all
+// versions, which walks the whole versions directory.
+const pruneInterval = time.Hour
+
+type Options struct {
+	// Watch enables inotify based change detection in addition to periodic scans.
+	Watch bool
+	// Reconcile compares source files with an existing destination before
+	// the first scan and copies only files that are missing or different.
+	Reconcile bool
+	// RemoveExtra removes files found only in the destination during reconcile.
+	RemoveExtra bool
+	// Hasher computes file hashes, MD5 is used if it is not set.
+	Hasher utils.Hasher
+	// Preserve selects file metadata copied to the destination.
+	Preserve utils.Preserve
+	// Symlinks selects how symlinks are synced, LinkCopy if it is not set.
+	Symlinks LinkPolicy
+	// ReportSpecial logs skipped sockets, FIFOs and devices as warnings.
+	ReportSpecial bool
+	// Ignore holds gitignore style patterns applied before .syncignore files.
+	Ignore []string
+	// VerifyInterval is how often Run checks the destination against the
+	// index, zero disables the checks.
+	VerifyInterval time.Duration
+	// Repair restores modified and missing destination files from the source
+	// and removes unexpected ones when the destination is verified.
+	Repair bool
+	// CopyWorkers is the number of files copied at once, the number of CPUs
+	// if it is not set.
+	CopyWorkers int
+	// HashWorkers is the number of files hashed at once, the number of CPUs
+	// if it is not set.
+	HashWorkers int
+	// RetryAttempts is how many times a failing file is tried before it is
+	// given up, defaultRetryAttempts if it is not set.
+	RetryAttempts int
+	// RetryDelay is the delay before the first retry, it doubles with every
+	// further attempt up to RetryMaxDelay.
+	RetryDelay    time.Duration
+	RetryMaxDelay time.Duration
+	// Versions keeps previous copies of overwritten and deleted destination
+	// files, they are overwritten and deleted for good if it is not set.
+	Versions *versions.Store
+	// TwoWay syncs changes made in the destination directory back to the
+	// source, conflicting changes are resolved by Conflicts.
+	TwoWay    bool
+	Conflicts ConflictPolicy
+	// MaxDeletes caps the files deleted in one pass because they are missing
+	// in the source. Deletions are always held while the source directory is
+	// missing.
+	MaxDeletes DeleteLimit
+	// RefuseEmpty holds deletions while the source directory is empty.
+	RefuseEmpty bool
+	// Marker is a file that must exist in the source directory for files to
+	// be deleted, so an unmounted share is not taken for an emptied one.
+	Marker string
+	// AcknowledgeDeletes lets the deletions of the first pass past the
+	// limits, as if they were held and acknowledged.
+	AcknowledgeDeletes bool
+	// Copy copies file contents, utils.CopyFull if it is not set.
+	Copy utils.CopyFunc
+}
+
+type visitFunc func(fileName, path string, info fs.FileInfo)
+
 type DirScanner struct {
 	wg           *sync.WaitGroup
 	ctx          context.Context
@@ -25,81 +103,503 @@ type DirScanner struct {
 	syncDone     chan string
 	storage      generated_storage.StorageWithLogrus
 	timeInterval int
+	opts         Options
+	reconciling  int32
+	pending      int64
+	stats        LinkStats
+	scanned      int64
+	written      int64
+	// pruned is the time of the last PruneAll in unix nanoseconds.
+	pruned  int64
+	wrapper FileScanner
+	walks   int32
+	trigger chan struct{}
+	// failures tells Run that a file failed, so it sets the retry timer.
+	failures chan struct{}
+	// progress wakes Drain when a walk or a copy is finished.
+	progress     chan struct{}
+	pauseMu      sync.Mutex
+	resumed      chan struct{}
+	draining     int32
+	moved        movedFiles
+	scanMu       sync.Mutex
+	deletesMu    sync.Mutex
+	deletesHeld  error
+	deletesAcked bool
+	// acks counts acknowledgements, so a pass drops only the ones given
+	// before it started.
+	acks        int
+	plan        *plan.Plan
+	workersOnce sync.Once
+	copied      chan copyResult
+	hashSlots   chan struct{}
+}
+
+func (d *DirScanner) WithOptions(opts Options) *DirScanner {
+	d.opts = opts
+	if opts.AcknowledgeDeletes {
+		d.deletesMu.Lock()
+		d.deletesAcked = true
+		d.acks++
+		d.deletesMu.Unlock()
+	}
+	return d
+}
+
+// WithWrapper makes the scanner call ScanDir, Reconcile and CopyFile through
+// wrapper, so a wrapper collecting metrics sees the calls made by Run and
+// SyncOnce too.
+func (d *DirScanner) WithWrapper(wrapper FileScanner) *DirScanner {
+	d.wrapper = wrapper
+	return d
+}
+
+func (d *DirScanner) self() FileScanner {
+	if d.wrapper == nil {
+		return d
+	}
+	return d.wrapper
+}
+
+// Scanned returns the number of source files seen by walks since start.
+func (d *DirScanner) Scanned() int64 {
+	return atomic.LoadInt64(&d.scanned)
+}
+
+// Written returns the number of bytes written to the destination by copies
+// since start. Links add nothing, delta copies only the changed blocks.
+func (d *DirScanner) Written() int64 {
+	return atomic.LoadInt64(&d.written)
 }
 
 func (d *DirScanner) Run() {
 	ticker := time.NewTicker(time.Duration(d.timeInterval) * time.Second)
 	defer ticker.Stop()
+	var changes <-chan []string
+	var overflow <-chan struct{}
+	if d.opts.Watch {
+		watcher, err := NewWatcher(d.sourceDir, d.logger)
+		if err != nil {
+			d.logger.Errorf("Can't watch %v, only periodic scans are used: %v", d.sourceDir, err)
+		} else {
+			defer watcher.Close()
+			changes = debounce(d.ctx.Done(), watcher.Events, debounceInterval, debounceMaxWait)
+			overflow = watcher.Overflow
+		}
+	}
+	var verify <-chan time.Time
+	if d.opts.VerifyInterval > 0 && !d.opts.TwoWay {
+		verifyTicker := time.NewTicker(d.opts.VerifyInterval)
+		defer verifyTicker.Stop()
+		verify = verifyTicker.C
+	}
+	d.startWorkers()
+	retry := time.NewTimer(time.Hour)
+	defer retry.Stop()
+	d.scheduleRetry(retry)
+	if d.opts.TwoWay {
+		d.wg.Add(1)
+		go d.scan()
+	} else if d.opts.Reconcile {
+		atomic.StoreInt32(&d.reconciling, 1)
+		d.wg.Add(1)
+		go d.self().Reconcile()
+	}
 	for {
 		select {
 		case <-d.ctx.Done():
 			d.Close()
 			return
 		case <-ticker.C:
-			d.wg.Add(2)
-			go d.ScanDir()
-			go d.storage.CheckIfExistAndRemove(d.destDir, d.wg)
-		case fileName := <-d.filesToSync:
+			if atomic.LoadInt32(&d.reconciling) == 1 || d.held() {
+				continue
+			}
+			d.wg.Add(1)
+			go d.scan()
+		case <-d.trigger:
+			if atomic.LoadInt32(&d.reconciling) == 1 || d.held() {
+				continue
+			}
+			d.wg.Add(1)
+			go d.scan()
+			d.scheduleRetry(retry)
+		case <-verify:
+			if atomic.LoadInt32(&d.reconciling) == 1 || d.held() {
+				continue
+			}
+			d.wg.Add(1)
+			go d.scrub()
+		case paths, ok := <-changes:
+			if !ok {
+				changes = nil
+				continue
+			}
+			if d.held() {
+				continue
+			}
+			d.wg.Add(1)
+			if d.opts.TwoWay {
+				go d.scan()
+			} else {
+				go d.syncPaths(paths)
+			}
+		case <-overflow:
+			if d.held() {
+				continue
+			}
+			d.logger.Warnf("Watch event queue overflow, rescanning %v", d.sourceDir)
+			d.wg.Add(1)
+			go d.scan()
+		case result := <-d.copied:
+			d.copyFinished(result)
+		case <-retry.C:
+			if d.held() || d.opts.TwoWay {
+				continue
+			}
 			d.wg.Add(1)
-			go d.CopyFile(fileName)
+			go d.retryDueFiles()
+		case <-d.failures:
+			d.scheduleRetry(retry)
 		case fileName := <-d.syncDone:
+			d.progressed()
 			d.wg.Add(1)
 			go d.storage.ChangeStatusToSync(fileName, d.wg)
 		}
 	}
 }
 
+// scan scans the source directory and then deletes removed files, so moved
+// files are renamed in the destination before their old names are deleted.
+// In two-way mode it runs a two-way pass instead. It does nothing while
+// another scan is running, so a file is not queued by both.
+func (d *DirScanner) scan() {
+	defer d.wg.Done()
+	if !d.scanMu.TryLock() {
+		return
+	}
+	defer d.scanMu.Unlock()
+	defer d.beginPass()()
+	if d.opts.TwoWay {
+		if err := d.syncTwoWay(); err != nil && !errors.Is(err, ErrDeletesHeld) {
+			d.logger.Errorf("Two-way sync failed: %v", err)
+		}
+		return
+	}
+	d.wg.Add(1)
+	d.self().ScanDir()
+	d.removeDeleted()
+}
+
 func (d *DirScanner) Wait() {
 	d.wg.Wait()
 }
 
+// Close marks the files whose copies are finished as synced, so they are not
+// copied again after a restart. Files still queued are left to the next run.
 func (d *DirScanner) Close() error {
 	d.logger.Println("Closing Scanner")
-	for len(d.filesToSync) > 0 && len(d.syncDone) > 0 {
-		time.Sleep(time.Millisecond * 10)
+	for {
+		select {
+		case fileName := <-d.syncDone:
+			d.wg.Add(1)
+			d.storage.ChangeStatusToSync(fileName, d.wg)
+		default:
+			return nil
+		}
 	}
-	return nil
 }
 
 func (d *DirScanner) CopyFile(fileName string) error {
 	defer d.wg.Done()
 	dst := filepath.Join(d.destDir, fileName)
 	src := filepath.Join(d.sourceDir, fileName)
-	sourceFileStat, err := os.Stat(src)
+	sourceFileStat, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(dst), 0755); err == nil {
+		err = d.copy(fileName, src, dst, sourceFileStat)
+	}
+	if err != nil {
+		return err
+	}
+	// Once stopped, the file is still marked synced if there is room, so it
+	// is not copied again after a restart.
+	select {
+	case d.syncDone <- fileName:
+	default:
+		select {
+		case d.syncDone <- fileName:
+		case <-d.ctx.Done():
+		}
+	}
+	return nil
+}
+
+// SyncOnce runs a single sync pass: it scans the source directory, copies
+// everything queued and removes deleted files. Failed files are retried with
+// backoff until they are synced or given up. Returns an error if the pass was
+// interrupted or some files are left failed. In two-way mode it runs a single
+// two-way pass.
+func (d *DirScanner) SyncOnce() error {
+	defer d.beginPass()()
+	if d.opts.TwoWay {
+		return d.syncTwoWay()
+	}
+	err := d.pass(func() error {
+		d.wg.Add(1)
+		if d.opts.Reconcile {
+			return d.self().Reconcile()
+		}
+		return d.self().ScanDir()
+	})
+	if err != nil {
+		return err
+	}
+	removeErr := d.removeDeleted()
+	if removeErr != nil && !errors.Is(removeErr, ErrDeletesHeld) {
+		return removeErr
+	}
+	if err = d.RetryFailed(); err != nil {
+		return err
+	}
+	return removeErr
+}
+
+// pass runs work and copies the files it queues until all of them are done.
+func (d *DirScanner) pass(work func() error) error {
+	d.startWorkers()
+	done := make(chan error, 1)
+	go func() {
+		done <- work()
+	}()
+	var workErr error
+	for done != nil || atomic.LoadInt64(&d.pending) > 0 || len(d.syncDone) > 0 {
+		select {
+		case <-d.ctx.Done():
+			return d.ctx.Err()
+		case err := <-done:
+			workErr, done = err, nil
+		case result := <-d.copied:
+			d.copyFinished(result)
+		case fileName := <-d.syncDone:
+			d.wg.Add(1)
+			go d.storage.ChangeStatusToSync(fileName, d.wg)
+		}
+	}
+	d.wg.Wait()
+	return workErr
+}
+
+func (d *DirScanner) copy(fileName, src, dst string, info fs.FileInfo) error {
+	if linked, err := d.copyLink(fileName, src, dst, info); linked || err != nil {
+		return err
+	}
+	if info.Mode()&fs.ModeSymlink != 0 {
+		target, err := os.Stat(src)
+		if err != nil {
+			return err
+		}
+		info = target
+	}
+	d.logger.Printf("Copy file %v with size %v bytes\n", fileName, info.Size())
+	if d.opts.Versions != nil {
+		if err := d.opts.Versions.Save(fileName); err != nil {
+			return err
+		}
+	}
+	stats, err := d.copier()(src, dst, d.opts.Preserve)
 	if err != nil {
 		return err
 	}
-	d.logger.Printf("Copy file %v with size %v bytes\n", sourceFileStat.Name(), sourceFileStat.Size())
-	err = utils.CopyFilesWithOsRW(src, dst)
-	d.syncDone <- fileName
-	return err
+	d.wrote(fileName, stats)
+	return nil
+}
+
+// wrote accounts for the bytes a copy of fileName wrote.
+func (d *DirScanner) wrote(fileName string, stats utils.CopyStats) {
+	atomic.AddInt64(&d.written, stats.Written)
+	if stats.Matched > 0 {
+		d.logger.Infof("Wrote %v bytes of %v, %v bytes were found in the old copy", stats.Written, fileName, stats.Matched)
+	}
 }
 
 func (d *DirScanner) ScanDir() error {
 	defer d.wg.Done()
-	err := filepath.WalkDir(d.sourceDir, func(path string, dir fs.DirEntry, err error) error {
+	if err := d.walk(d.sourceDir, d.scanFile); err != nil {
+		return err
+	}
+	d.removeStaleDirs()
+	d.pruneVersions()
+	d.logger.Infof("Scan of %v finished, links and special files so far: %+v", d.sourceDir, d.Stats())
+	return nil
+}
+
+// Reconcile seeds the storage with source files that already have an
+// identical copy in the destination and queues the rest for copying.
+// Files that exist only in the destination are reported and removed
+// if RemoveExtra is set.
+func (d *DirScanner) Reconcile() error {
+	defer d.wg.Done()
+	defer atomic.StoreInt32(&d.reconciling, 0)
+	d.logger.Infof("Reconcile %v with %v", d.sourceDir, d.destDir)
+	if err := d.walk(d.sourceDir, d.reconcileFile); err != nil {
+		return err
+	}
+	return d.checkExtraFiles()
+}
+
+// checkExtraFiles reports files that exist only in the destination and
+// removes them if RemoveExtra is set and the deletion guard allows it.
+func (d *DirScanner) checkExtraFiles() error {
+	var extra []string
+	total := 0
+	err := filepath.WalkDir(d.destDir, func(path string, dir fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if dir.IsDir() {
+			if internalDir(d.destDir, path) {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if utils.IsTempFile(dir.Name()) {
+			return nil
+		}
+		total++
+		fileName, err := filepath.Rel(d.destDir, path)
 		if err != nil {
-			fmt.Printf("prevent panic by handling failure accessing a path %q: %v\n", path, err)
 			return err
 		}
-		info, _ := dir.Info()
+		if _, err = os.Lstat(filepath.Join(d.sourceDir, fileName)); !os.IsNotExist(err) {
+			return nil
+		}
+		if !d.opts.RemoveExtra {
+			d.logger.Warnf("File %v exists only in destination directory", fileName)
+			return nil
+		}
+		extra = append(extra, fileName)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if d.plan != nil {
+		for _, fileName := range extra {
+			d.plan.Add(plan.Item{Action: plan.Delete, FileName: fileName})
+		}
+		return nil
+	}
+	if !d.allowDeletes(total, deletes{dir: d.sourceDir, count: len(extra)}) {
+		return nil
+	}
+	for _, fileName := range extra {
+		if err = d.removeDest(fileName); err != nil {
+			return err
+		}
+		d.logger.Infof("Delete file %v existing only in destination directory", fileName)
+	}
+	return nil
+}
+
+// SyncPath syncs a single changed path reported by the watcher. Directories
+// are scanned recursively, removed paths are deleted from the destination.
+func (d *DirScanner) SyncPath(path string) error {
+	defer d.wg.Done()
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		return d.removeDeleted()
+	}
+	return d.walk(path, d.scanFile)
+}
+
+func (d *DirScanner) walk(root string, visit visitFunc) error {
+	atomic.AddInt32(&d.walks, 1)
+	defer func() {
+		if atomic.AddInt32(&d.walks, -1) == 0 {
+			d.forgetMoved()
+		}
+		d.progressed()
+	}()
+	state := newWalkState(d.opts.Ignore)
+	fileName, err := filepath.Rel(d.sourceDir, root)
+	if err == nil && d.loadParentRules(state, fileName) {
+		return nil
+	}
+	return d.walkTree(root, state, visit)
+}
+
+// loadParentRules loads ignore files of the directories above fileName, so
+// a walk can start in the middle of the tree. It reports whether one of
+// those directories is excluded.
+func (d *DirScanner) loadParentRules(state *walkState, fileName string) bool {
+	if fileName == "." {
+		return false
+	}
+	dir := "."
+	for _, part := range strings.Split(filepath.Dir(fileName), string(filepath.Separator)) {
+		if part != "." {
+			dir = filepath.Join(dir, part)
+			if state.ignore.Match(filepath.ToSlash(dir), true) {
+				return true
+			}
+		}
+		if err := state.ignore.AddFile(filepath.ToSlash(dir), filepath.Join(d.sourceDir, dir, ignore.FileName)); err != nil {
+			d.logger.Warnf("Can't read ignore rules in %v: %v", dir, err)
+		}
+	}
+	return false
+}
+
+func (d *DirScanner) walkTree(root string, state *walkState, visit visitFunc) error {
+	err := filepath.WalkDir(root, func(path string, dir fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			d.logger.Warnf("Skip path %v: %v", path, err)
+			return nil
+		}
+		fileName, err := filepath.Rel(d.sourceDir, path)
+		if err != nil {
+			return err
+		}
+		path = filepath.Join(d.sourceDir, fileName)
+		if fileName != "." && state.ignore.Match(filepath.ToSlash(fileName), dir.IsDir()) {
+			d.logger.Debugf("Exclude %v", fileName)
+			if dir.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if dir.IsDir() {
+			if err = state.ignore.AddFile(filepath.ToSlash(fileName), filepath.Join(path, ignore.FileName)); err != nil {
+				d.logger.Warnf("Can't read ignore rules in %v: %v", fileName, err)
+			}
+		}
+		info, err := dir.Info()
+		if err != nil {
+			d.logger.Warnf("Skip path %v: %v", path, err)
+			return nil
+		}
 		if !info.IsDir() {
-			file, ok := d.storage.GetFile(dir.Name())
-			if !ok {
-				file.Hash = utils.FileMD5(path)
-				file.FilePath = path
-				file.FileName = dir.Name()
-				file.LastModified = info.ModTime()
-				d.wg.Add(1)
-				go d.storage.AddFileToSync(file, d.wg, d.filesToSync)
-			} else if ok && file.Status != storage.InSync {
-				res, hash := d.storage.IsFileChanged(path, info.ModTime())
-				if res {
-					file.Hash = hash
-					d.wg.Add(1)
-					go d.storage.AddFileToSync(file, d.wg, d.filesToSync)
-				}
+			atomic.AddInt64(&d.scanned, 1)
+		}
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+			if fileName != "." && d.plan == nil {
+				return os.MkdirAll(filepath.Join(d.destDir, fileName), 0755)
 			}
+		case mode&fs.ModeSymlink != 0:
+			d.visitSymlink(state, fileName, path, info, visit)
+		case mode.IsRegular():
+			if primary, ok := state.hardlink(fileName, info); ok {
+				d.scanHardlink(fileName, path, info, primary)
+			} else {
+				visit(fileName, path, info)
+			}
+		default:
+			d.skipSpecial(fileName, info)
 		}
 		return nil
 	})
@@ -109,6 +609,266 @@ func (d *DirScanner) ScanDir() error {
 	return nil
 }
 
+func (d *DirScanner) scanFile(fileName, path string, info fs.FileInfo) {
+	file, ok := d.storage.GetFile(fileName)
+	if ok && !retryDue(file, info) {
+		return
+	}
+	if !ok || file.Status == storage.Failed || file.Status == storage.Abandoned {
+		file.FilePath = path
+		file.FileName = fileName
+		file.LastModified = info.ModTime()
+		release := d.hashSlot()
+		hash, err := d.hasher().Sum(path)
+		release()
+		if err != nil {
+			d.hashFailed(file, err)
+			return
+		}
+		file.Hash = hash
+		file.HashAlgo = d.hasher().Name()
+		file.Metadata = d.metadata(path, info)
+		file.LastError = ""
+		file.LinkTarget, file.HardlinkOf = "", ""
+		if !ok && d.moveFile(file) {
+			return
+		}
+		d.queue(file)
+	} else if file.Status != storage.InSync {
+		release := d.hashSlot()
+		res, hash, err := d.storage.IsFileChanged(fileName, path, info.ModTime())
+		release()
+		if err != nil {
+			d.hashFailed(file, err)
+			return
+		}
+		if res {
+			file.Hash = hash
+			file.HashAlgo = d.hasher().Name()
+			file.LastModified = info.ModTime()
+			file.Metadata = d.metadata(path, info)
+			file.LinkTarget, file.HardlinkOf = "", ""
+			d.queue(file)
+		} else if d.opts.Preserve.Any() {
+			d.syncMetadata(file, path, info)
+		}
+	}
+}
+
+func (d *DirScanner) metadata(path string, info fs.FileInfo) string {
+	metadata, err := utils.MetadataFingerprint(path, info, d.opts.Preserve)
+	if err != nil {
+		d.logger.Warnf("Can't read metadata of %v: %v", path, err)
+	}
+	return metadata
+}
+
+// syncMetadata applies metadata changes of a file whose content is in sync,
+// such as chmod or touch, without copying it again.
+func (d *DirScanner) syncMetadata(file storage.FilesInfo, path string, info fs.FileInfo) {
+	metadata, err := utils.MetadataFingerprint(path, info, d.opts.Preserve)
+	if err != nil {
+		d.logger.Warnf("Can't read metadata of %v: %v", path, err)
+		return
+	}
+	if metadata == file.Metadata {
+		return
+	}
+	if d.plan != nil {
+		d.plan.Add(plan.Item{Action: plan.Metadata, FileName: file.FileName})
+		return
+	}
+	if err = utils.CopyMetadata(path, filepath.Join(d.destDir, file.FileName), d.opts.Preserve); err != nil {
+		d.logger.Warnf("Can't update metadata of %v: %v", file.FileName, err)
+		return
+	}
+	file.Metadata = metadata
+	file.LastModified = info.ModTime()
+	d.storage.PutFile(file)
+	d.logger.Infof("Update metadata of file %v", file.FileName)
+}
+
+// hashFailed records a file that could not be hashed so it is retried later.
+// Files removed since they were listed are skipped silently.
+func (d *DirScanner) hashFailed(file storage.FilesInfo, err error) {
+	if errors.Is(err, fs.ErrNotExist) {
+		d.logger.Infof("File %v disappeared before it was hashed", file.FileName)
+		return
+	}
+	d.fail(file, err)
+}
+
+// internalDir reports whether the directory path under root belongs to the
+// tool rather than to the synced tree. Only the top directories of root are
+// the tool's, directories with the same names deeper in the tree are synced.
+func internalDir(root, path string) bool {
+	fileName, err := filepath.Rel(root, path)
+	return err == nil && (fileName == storage.IndexDirName || fileName == versions.DirName)
+}
+
+// removeDest deletes a destination file, keeping it as a version if
+// versioning is on.
+func (d *DirScanner) removeDest(fileName string) error {
+	if d.opts.Versions != nil {
+		return d.opts.Versions.Remove(fileName)
+	}
+	return os.Remove(filepath.Join(d.destDir, fileName))
+}
+
+// pruneVersions removes versions the retention policy no longer keeps, at
+// most once per pruneInterval. Saving a version prunes the versions of its
+// file anyway, so only versions that got too old wait for it.
+func (d *DirScanner) pruneVersions() {
+	if d.opts.Versions == nil || d.plan != nil {
+		return
+	}
+	last, now := atomic.LoadInt64(&d.pruned), time.Now()
+	if now.Sub(time.Unix(0, last)) < pruneInterval || !atomic.CompareAndSwapInt64(&d.pruned, last, now.UnixNano()) {
+		return
+	}
+	if pruned, err := d.opts.Versions.PruneAll(); err != nil {
+		d.logger.Warnf("Can't prune old versions: %v", err)
+	} else if pruned > 0 {
+		d.logger.Infof("Pruned %v old versions", pruned)
+	}
+}
+
+// removeStaleDirs removes empty destination directories whose counterpart
+// no longer exists in the source directory.
+func (d *DirScanner) removeStaleDirs() {
+	var dirs []string
+	filepath.WalkDir(d.destDir, func(path string, dir fs.DirEntry, err error) error {
+		if err != nil || !dir.IsDir() {
+			return nil
+		}
+		if internalDir(d.destDir, path) {
+			return fs.SkipDir
+		}
+		if path != d.destDir {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	for i := len(dirs) - 1; i >= 0; i-- {
+		fileName, _ := filepath.Rel(d.destDir, dirs[i])
+		if _, err := os.Stat(filepath.Join(d.sourceDir, fileName)); os.IsNotExist(err) {
+			if os.Remove(dirs[i]) == nil {
+				d.logger.Infof("Delete directory %v from destination directory", fileName)
+			}
+		}
+	}
+}
+
+func (d *DirScanner) hasher() utils.Hasher {
+	if d.opts.Hasher == nil {
+		return utils.DefaultHasher()
+	}
+	return d.opts.Hasher
+}
+
+func (d *DirScanner) copier() utils.CopyFunc {
+	if d.opts.Copy == nil {
+		return utils.CopyFull
+	}
+	return d.opts.Copy
+}
+
+func (d *DirScanner) reconcileFile(fileName, path string, info fs.FileInfo) {
+	if _, ok := d.storage.GetFile(fileName); ok {
+		d.scanFile(fileName, path, info)
+		return
+	}
+	file := storage.FilesInfo{
+		FileName:     fileName,
+		FilePath:     path,
+		HashAlgo:     d.hasher().Name(),
+		LastModified: info.ModTime(),
+	}
+	release := d.hashSlot()
+	hash, err := d.hasher().Sum(path)
+	release()
+	if err != nil {
+		d.hashFailed(file, err)
+		return
+	}
+	file.Hash = hash
+	file.Metadata = d.metadata(path, info)
+	if d.sameAsDest(fileName, hash) {
+		file.Status = storage.Sync
+		d.storage.PutFile(file)
+		return
+	}
+	d.queue(file)
+}
+
+func (d *DirScanner) sameAsDest(fileName, hash string) bool {
+	dst := filepath.Join(d.destDir, fileName)
+	if dstInfo, err := os.Stat(dst); err != nil || !dstInfo.Mode().IsRegular() {
+		return false
+	}
+	release := d.hashSlot()
+	defer release()
+	dstHash, err := d.hasher().Sum(dst)
+	return err == nil && dstHash == hash
+}
+
+// debounce groups paths arriving on events until no new event comes for
+// interval, or for at most maxWait since the first path of the group, and
+// sends each group once, without duplicates. It stops when done is closed.
+func debounce(done <-chan struct{}, events <-chan string, interval, maxWait time.Duration) <-chan []string {
+	batches := make(chan []string)
+	go func() {
+		defer close(batches)
+		pending := map[string]struct{}{}
+		timer := time.NewTimer(interval)
+		timer.Stop()
+		var deadline <-chan time.Time
+		for {
+			select {
+			case path, ok := <-events:
+				if !ok {
+					return
+				}
+				if len(pending) == 0 {
+					deadline = time.After(maxWait)
+				}
+				pending[path] = struct{}{}
+				timer.Reset(interval)
+				continue
+			case <-timer.C:
+			case <-deadline:
+			case <-done:
+				drain(events)
+				return
+			}
+			if len(pending) == 0 {
+				continue
+			}
+			timer.Stop()
+			deadline = nil
+			batch := make([]string, 0, len(pending))
+			for path := range pending {
+				batch = append(batch, path)
+			}
+			pending = map[string]struct{}{}
+			select {
+			case batches <- batch:
+			case <-done:
+				drain(events)
+				return
+			}
+		}
+	}()
+	return batches
+}
+
+// drain discards events until the watcher closes the channel, so it is not
+// blocked sending to it.
+func drain(events <-chan string) {
+	for range events {
+	}
+}
+
 func NewDirScanner(srcDir, dstDir string, ctx context.Context, fileToSync chan string, syncDone chan string, logger *logrus.Entry, storage generated_storage.StorageWithLogrus, wg *sync.WaitGroup, timeInterval int) *DirScanner {
 	return &DirScanner{
 		wg:           wg,
@@ -120,5 +880,8 @@ func NewDirScanner(srcDir, dstDir string, ctx context.Context, fileToSync chan s
 		storage:      storage,
 		syncDone:     syncDone,
 		timeInterval: timeInterval,
+		trigger:      make(chan struct{}, 1),
+		failures:     make(chan struct{}, 1),
+		progress:     make(chan struct{}, 1),
 	}
 }
@@ -0,0 +1,194 @@
+package scanner
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ErrDeletesHeld is returned by SyncOnce when the deletion guard holds the
+// deletions of files missing in the source.
+var ErrDeletesHeld = errors.New("deletions are held")
+
+// DeleteLimit caps the files deleted in one pass, as a number or as a
+// percentage of the files in the index. The zero value means no limit.
+type DeleteLimit struct {
+	Count   int
+	Percent float64
+}
+
+// ParseDeleteLimit parses a number of files like 100 or a percentage like
+// 10%. Empty and zero values mean no limit.
+func ParseDeleteLimit(value string) (DeleteLimit, error) {
+	if value == "" {
+		return DeleteLimit{}, nil
+	}
+	if percent := strings.TrimSuffix(value, "%"); percent != value {
+		p, err := strconv.ParseFloat(percent, 64)
+		if err != nil || p < 0 || p > 100 {
+			return DeleteLimit{}, fmt.Errorf("invalid deletion limit %q, want a percentage from 0%% to 100%%", value)
+		}
+		return DeleteLimit{Percent: p}, nil
+	}
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 0 {
+		return DeleteLimit{}, fmt.Errorf("invalid deletion limit %q, want a number of files or a percentage", value)
+	}
+	return DeleteLimit{Count: count}, nil
+}
+
+func (l DeleteLimit) String() string {
+	if l.Percent > 0 {
+		return strconv.FormatFloat(l.Percent, 'f', -1, 64) + "%"
+	}
+	return strconv.Itoa(l.Count)
+}
+
+// exceeded reports whether deleting count of total files goes over the
+// limit.
+func (l DeleteLimit) exceeded(count, total int) bool {
+	if l.Count > 0 && count > l.Count {
+		return true
+	}
+	return l.Percent > 0 && float64(count)*100 > l.Percent*float64(total)
+}
+
+// deletes are files about to be deleted because they are missing in dir.
+type deletes struct {
+	dir   string
+	count int
+}
+
+// allowDeletes reports whether the pending deletions may run, out of total
+// files. Once a guard trips, all deletions are held until they are
+// acknowledged with AcknowledgeDeletes, even if the guard passes again. An
+// acknowledgement lets the next deletions past the limits, but never past
+// a missing directory or marker file.
+func (d *DirScanner) allowDeletes(total int, pending ...deletes) bool {
+	count := 0
+	for _, p := range pending {
+		count += p.count
+	}
+	if count == 0 {
+		return true
+	}
+	d.deletesMu.Lock()
+	defer d.deletesMu.Unlock()
+	var err error
+	for _, p := range pending {
+		if err = d.checkDeletes(p, total, d.deletesAcked); err != nil {
+			break
+		}
+	}
+	acked := d.deletesAcked
+	d.deletesAcked = false
+	switch {
+	case err == nil && acked:
+		d.deletesHeld = nil
+		d.logger.Warnf("Deleting %v files as acknowledged", count)
+		return true
+	case err == nil && d.deletesHeld == nil:
+		return true
+	case err != nil && (d.deletesHeld == nil || acked):
+		d.deletesHeld = err
+		d.logger.Errorf("DELETIONS HELD: %v. %v files are not deleted until the deletions are acknowledged", err, count)
+	default:
+		d.logger.Warnf("Deletions are held: %v. %v files are not deleted", d.deletesHeld, count)
+	}
+	return false
+}
+
+// checkDeletes returns why the pending deletions are not safe. Limits and
+// the empty directory check are skipped if acked is set.
+func (d *DirScanner) checkDeletes(p deletes, total int, acked bool) error {
+	if _, err := os.Stat(p.dir); err != nil {
+		return fmt.Errorf("directory %v is not available: %v", p.dir, err)
+	}
+	if p.dir == d.sourceDir && d.opts.Marker != "" {
+		if _, err := os.Stat(filepath.Join(p.dir, d.opts.Marker)); err != nil {
+			return fmt.Errorf("marker file %v is missing in %v", d.opts.Marker, p.dir)
+		}
+	}
+	if acked || p.count == 0 {
+		return nil
+	}
+	if d.opts.RefuseEmpty && emptyDir(p.dir) {
+		return fmt.Errorf("directory %v is empty", p.dir)
+	}
+	if d.opts.MaxDeletes.exceeded(p.count, total) {
+		return fmt.Errorf("%v of %v files are missing in %v, over the limit of %v", p.count, total, p.dir, d.opts.MaxDeletes)
+	}
+	return nil
+}
+
+// emptyDir reports whether there are no files under dir, leaving out the
+// tool's directories.
+func emptyDir(dir string) bool {
+	errFound := errors.New("found")
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		switch {
+		case err != nil:
+			return err
+		case entry.IsDir() && internalDir(dir, path):
+			return fs.SkipDir
+		case entry.IsDir():
+			return nil
+		}
+		return errFound
+	})
+	return err == nil
+}
+
+// DeletesHeld returns why deletions are held, or nil if they are not.
+func (d *DirScanner) DeletesHeld() error {
+	d.deletesMu.Lock()
+	defer d.deletesMu.Unlock()
+	return d.deletesHeld
+}
+
+// AcknowledgeDeletes lets the held deletions run with the next scan, which
+// is started right away. It does nothing while no deletions are held.
+func (d *DirScanner) AcknowledgeDeletes() {
+	d.deletesMu.Lock()
+	if d.deletesHeld == nil {
+		d.deletesMu.Unlock()
+		d.logger.Warnf("No deletions are held, nothing to acknowledge")
+		return
+	}
+	d.deletesAcked = true
+	d.acks++
+	d.deletesMu.Unlock()
+	d.logger.Warnf("Deletions acknowledged")
+	d.ScanNow()
+}
+
+// beginPass returns the function ending a pass. It drops an
+// acknowledgement given before the pass and not used by it, so it does not
+// let a later mass deletion through.
+func (d *DirScanner) beginPass() func() {
+	d.deletesMu.Lock()
+	acks := d.acks
+	d.deletesMu.Unlock()
+	return func() {
+		d.deletesMu.Lock()
+		defer d.deletesMu.Unlock()
+		if d.acks == acks {
+			d.deletesAcked = false
+		}
+	}
+}
+
+// removeDeleted deletes the destination copies of files missing in the
+// source, unless the deletion guard holds them.
+func (d *DirScanner) removeDeleted() error {
+	removed := d.storage.FindRemoved()
+	if !d.allowDeletes(d.storage.Len(), deletes{dir: d.sourceDir, count: len(removed)}) {
+		return fmt.Errorf("%w: %v", ErrDeletesHeld, d.DeletesHeld())
+	}
+	d.wg.Add(1)
+	return d.storage.CheckIfExistAndRemove(d.destDir, d.wg)
+}
@@ -0,0 +1,214 @@
+package scanner
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"sync_dir/internal/ignore"
+	"sync_dir/internal/storage"
+	"sync_dir/internal/utils"
+)
+
+// LinkPolicy tells the scanner what to do with symlinks in the source directory.
+type LinkPolicy string
+
+const (
+	// LinkCopy recreates symlinks in the destination with the same target.
+	LinkCopy LinkPolicy = "copy"
+	// LinkFollow copies the files and directories symlinks point to.
+	LinkFollow LinkPolicy = "follow"
+	// LinkSkip leaves symlinks out of the destination.
+	LinkSkip LinkPolicy = "skip"
+)
+
+func ParseLinkPolicy(value string) (LinkPolicy, error) {
+	switch policy := LinkPolicy(value); policy {
+	case LinkCopy, LinkFollow, LinkSkip:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown symlink policy %q, supported: copy, follow, skip", value)
+}
+
+// LinkStats counts decisions made for links and special files since start.
+type LinkStats struct {
+	SymlinksCopied   int64
+	SymlinksFollowed int64
+	SymlinksSkipped  int64
+	Hardlinks        int64
+	SpecialSkipped   int64
+}
+
+func (d *DirScanner) Stats() LinkStats {
+	return LinkStats{
+		SymlinksCopied:   atomic.LoadInt64(&d.stats.SymlinksCopied),
+		SymlinksFollowed: atomic.LoadInt64(&d.stats.SymlinksFollowed),
+		SymlinksSkipped:  atomic.LoadInt64(&d.stats.SymlinksSkipped),
+		Hardlinks:        atomic.LoadInt64(&d.stats.Hardlinks),
+		SpecialSkipped:   atomic.LoadInt64(&d.stats.SpecialSkipped),
+	}
+}
+
+// walkState keeps what a single walk has already seen: directories of the
+// symlinks being followed, to break loops, the first path of every hard
+// link group and ignore rules of the visited directories.
+type walkState struct {
+	dirs      map[string]bool
+	hardlinks map[utils.FileID]string
+	ignore    *ignore.Matcher
+}
+
+func newWalkState(patterns []string) *walkState {
+	return &walkState{
+		dirs:      map[string]bool{},
+		hardlinks: map[utils.FileID]string{},
+		ignore:    ignore.NewMatcher(patterns),
+	}
+}
+
+// hardlink returns the first path of the hard link group the file belongs to
+// if the file is not that first path itself.
+func (s *walkState) hardlink(fileName string, info fs.FileInfo) (string, bool) {
+	id, ok := utils.HardlinkID(info)
+	if !ok {
+		return "", false
+	}
+	if primary, ok := s.hardlinks[id]; ok {
+		return primary, true
+	}
+	s.hardlinks[id] = fileName
+	return "", false
+}
+
+// isLoop reports whether the directory symlink at path points to one of its
+// own parent directories or to a directory that is being followed already.
+func (s *walkState) isLoop(path string) bool {
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil || s.dirs[real] {
+		return true
+	}
+	parent, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		return true
+	}
+	return parent == real || strings.HasPrefix(parent, real+string(filepath.Separator))
+}
+
+func (d *DirScanner) linkPolicy() LinkPolicy {
+	if d.opts.Symlinks == "" {
+		return LinkCopy
+	}
+	return d.opts.Symlinks
+}
+
+func (d *DirScanner) visitSymlink(state *walkState, fileName, path string, info fs.FileInfo, visit visitFunc) {
+	switch d.linkPolicy() {
+	case LinkSkip:
+		atomic.AddInt64(&d.stats.SymlinksSkipped, 1)
+		d.logger.Debugf("Skip symlink %v", fileName)
+	case LinkFollow:
+		target, err := os.Stat(path)
+		if err != nil {
+			atomic.AddInt64(&d.stats.SymlinksSkipped, 1)
+			d.logger.Warnf("Skip broken symlink %v: %v", fileName, err)
+			return
+		}
+		atomic.AddInt64(&d.stats.SymlinksFollowed, 1)
+		d.logger.Debugf("Follow symlink %v", fileName)
+		if !target.IsDir() {
+			visit(fileName, path, target)
+			return
+		}
+		if state.isLoop(path) {
+			atomic.AddInt64(&d.stats.SymlinksSkipped, 1)
+			d.logger.Warnf("Skip symlink %v pointing to its own parent directory", fileName)
+			return
+		}
+		real, _ := filepath.EvalSymlinks(path)
+		state.dirs[real] = true
+		defer delete(state.dirs, real)
+		if err = d.walkTree(path+string(filepath.Separator), state, visit); err != nil {
+			d.logger.Warnf("Can't follow symlink %v: %v", fileName, err)
+		}
+	default:
+		atomic.AddInt64(&d.stats.SymlinksCopied, 1)
+		d.scanSymlink(fileName, path, info)
+	}
+}
+
+func (d *DirScanner) scanSymlink(fileName, path string, info fs.FileInfo) {
+	target, err := os.Readlink(path)
+	if err != nil {
+		d.hashFailed(storage.FilesInfo{FileName: fileName, FilePath: path, LastModified: info.ModTime()}, err)
+		return
+	}
+	file, ok := d.storage.GetFile(fileName)
+	if ok && (file.Status == storage.InSync || file.Status == storage.Sync && file.LinkTarget == target || !retryDue(file, info)) {
+		return
+	}
+	d.logger.Infof("Copy symlink %v -> %v", fileName, target)
+	file = storage.FilesInfo{
+		FileName:     fileName,
+		FilePath:     path,
+		LinkTarget:   target,
+		LastModified: info.ModTime(),
+	}
+	d.queue(file)
+}
+
+// scanHardlink records a file that is a hard link to primary, which was met
+// earlier in the same walk, so the destination gets a hard link too.
+func (d *DirScanner) scanHardlink(fileName, path string, info fs.FileInfo, primary string) {
+	atomic.AddInt64(&d.stats.Hardlinks, 1)
+	file, ok := d.storage.GetFile(fileName)
+	if ok && (file.Status == storage.InSync || !retryDue(file, info)) {
+		return
+	}
+	if ok && file.Status == storage.Sync && file.HardlinkOf == primary &&
+		utils.SameFile(filepath.Join(d.destDir, primary), filepath.Join(d.destDir, fileName)) {
+		return
+	}
+	d.logger.Infof("Link file %v to %v", fileName, primary)
+	primaryFile, _ := d.storage.GetFile(primary)
+	file = storage.FilesInfo{
+		FileName:     fileName,
+		FilePath:     path,
+		Hash:         primaryFile.Hash,
+		HashAlgo:     primaryFile.HashAlgo,
+		LastModified: info.ModTime(),
+		HardlinkOf:   primary,
+	}
+	d.queue(file)
+}
+
+func (d *DirScanner) skipSpecial(fileName string, info fs.FileInfo) {
+	atomic.AddInt64(&d.stats.SpecialSkipped, 1)
+	if d.opts.ReportSpecial {
+		d.logger.Warnf("Skip special file %v (%v)", fileName, info.Mode().Type())
+	} else {
+		d.logger.Debugf("Skip special file %v (%v)", fileName, info.Mode().Type())
+	}
+}
+
+// copyLink recreates a symlink or hard link in the destination. It returns
+// false if the file has to be copied as a regular file instead.
+func (d *DirScanner) copyLink(fileName, src, dst string, info fs.FileInfo) (bool, error) {
+	if info.Mode()&fs.ModeSymlink != 0 && d.linkPolicy() == LinkCopy {
+		d.logger.Printf("Copy symlink %v\n", fileName)
+		return true, utils.CopySymlink(src, dst)
+	}
+	file, ok := d.storage.GetFile(fileName)
+	if !ok || file.HardlinkOf == "" {
+		return false, nil
+	}
+	primary, ok := d.storage.GetFile(file.HardlinkOf)
+	primaryDst := filepath.Join(d.destDir, file.HardlinkOf)
+	if _, err := os.Stat(primaryDst); err != nil || !ok || primary.Status != storage.Sync {
+		d.logger.Infof("File %v is not synced yet, copy %v instead of linking", file.HardlinkOf, fileName)
+		return false, nil
+	}
+	d.logger.Printf("Link file %v to %v\n", fileName, file.HardlinkOf)
+	return true, utils.LinkFile(primaryDst, dst)
+}
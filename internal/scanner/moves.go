@@ -0,0 +1,125 @@
+package scanner
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"sync_dir/internal/plan"
+	"sync_dir/internal/storage"
+	"sync_dir/internal/utils"
+)
+
+// movedFiles indexes by hash the synced files that are gone from the source
+// directory, the candidates for the old name of a new file. It is built on
+// the first new file of a walk, as finding removed files stats the whole
+// index, and dropped once no walk is running.
+type movedFiles struct {
+	sync.Mutex
+	byHash map[string][]storage.FilesInfo
+	// used holds the old names taken by moves in a dry run, where the index
+	// is not changed.
+	used map[string]bool
+}
+
+func moveKey(file storage.FilesInfo) string {
+	return file.HashAlgo + ":" + file.Hash
+}
+
+// forgetMoved drops the candidates, they are reloaded by the next walk.
+func (d *DirScanner) forgetMoved() {
+	d.moved.Lock()
+	defer d.moved.Unlock()
+	d.moved.byHash = nil
+}
+
+// findMoved returns a file removed from the source directory with the same
+// content as file, whose destination copy can be renamed instead of copying
+// file again.
+func (d *DirScanner) findMoved(file storage.FilesInfo) (storage.FilesInfo, bool) {
+	d.moved.Lock()
+	defer d.moved.Unlock()
+	if d.moved.byHash == nil {
+		d.moved.byHash = map[string][]storage.FilesInfo{}
+		for _, removed := range d.storage.FindRemoved() {
+			if removed.Status == storage.Sync && removed.Hash != "" && removed.LinkTarget == "" && removed.HardlinkOf == "" {
+				d.moved.byHash[moveKey(removed)] = append(d.moved.byHash[moveKey(removed)], removed)
+			}
+		}
+	}
+	key := moveKey(file)
+	for len(d.moved.byHash[key]) > 0 {
+		candidate := d.moved.byHash[key][0]
+		d.moved.byHash[key] = d.moved.byHash[key][1:]
+		// The candidate may have been renamed or deleted since the
+		// candidates were loaded.
+		current, ok := d.storage.GetFile(candidate.FileName)
+		if !ok || current.Hash != candidate.Hash || d.moved.used[candidate.FileName] {
+			continue
+		}
+		if _, err := os.Lstat(candidate.FilePath); !os.IsNotExist(err) {
+			continue
+		}
+		if _, err := os.Lstat(filepath.Join(d.destDir, candidate.FileName)); err != nil {
+			continue
+		}
+		return candidate, true
+	}
+	return storage.FilesInfo{}, false
+}
+
+// moveFile syncs a new file that has the content of a file removed from the
+// source directory by renaming the destination copy of the removed one. It
+// reports whether it did, otherwise the file has to be copied.
+func (d *DirScanner) moveFile(file storage.FilesInfo) bool {
+	if file.Hash == "" {
+		return false
+	}
+	old, ok := d.findMoved(file)
+	if !ok {
+		return false
+	}
+	if d.plan != nil {
+		d.moved.Lock()
+		if d.moved.used == nil {
+			d.moved.used = map[string]bool{}
+		}
+		d.moved.used[old.FileName] = true
+		d.moved.Unlock()
+		item := plan.Item{Action: plan.Move, FileName: file.FileName, From: old.FileName, Hash: file.Hash, HashAlgo: file.HashAlgo}
+		if info, err := os.Stat(file.FilePath); err == nil {
+			item.Size = info.Size()
+		}
+		d.plan.Add(item)
+		return true
+	}
+	src := filepath.Join(d.destDir, old.FileName)
+	dst := filepath.Join(d.destDir, file.FileName)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		d.logger.Warnf("Can't move %v to %v, copying it: %v", old.FileName, file.FileName, err)
+		return false
+	}
+	if d.opts.Versions != nil {
+		if err := d.opts.Versions.Save(file.FileName); err != nil {
+			d.logger.Warnf("Can't move %v to %v, copying it: %v", old.FileName, file.FileName, err)
+			return false
+		}
+	}
+	if err := os.Rename(src, dst); err != nil {
+		d.logger.Warnf("Can't move %v to %v, copying it: %v", old.FileName, file.FileName, err)
+		return false
+	}
+	if err := utils.CopyMetadata(file.FilePath, dst, d.opts.Preserve); err != nil {
+		d.logger.Warnf("Can't copy metadata of %v: %v", file.FileName, err)
+	}
+	d.storage.Rename(old.FileName, file)
+	d.logger.Infof("Move file %v to %v in destination directory", old.FileName, file.FileName)
+	return true
+}
+
+// planMoved reports whether a dry run moves the destination copy of a
+// removed file instead of deleting it.
+func (d *DirScanner) planMoved(fileName string) bool {
+	d.moved.Lock()
+	defer d.moved.Unlock()
+	return d.moved.used[fileName]
+}
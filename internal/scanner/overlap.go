@@ -0,0 +1,74 @@
+package scanner
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// NestedDest checks that the source and destination directories are
+// different trees, with absolute paths and symlinks resolved. If the
+// destination is inside the source it returns its path relative to the
+// source, so the caller can exclude it, otherwise an empty string.
+func NestedDest(srcDir, dstDir string) (string, error) {
+	src, err := resolvePath(srcDir)
+	if err != nil {
+		return "", err
+	}
+	dst, err := resolvePath(dstDir)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case src == dst:
+		return "", fmt.Errorf("source and destination are the same directory %v", src)
+	case within(src, dst):
+		return "", fmt.Errorf("source directory %v is inside destination directory %v", src, dst)
+	case within(dst, src):
+		return filepath.Rel(src, dst)
+	}
+	return "", nil
+}
+
+// Overlap reports whether two directories are the same tree or one of them
+// is inside the other, with absolute paths and symlinks resolved.
+func Overlap(dir1, dir2 string) (bool, error) {
+	path1, err := resolvePath(dir1)
+	if err != nil {
+		return false, err
+	}
+	path2, err := resolvePath(dir2)
+	if err != nil {
+		return false, err
+	}
+	return path1 == path2 || within(path1, path2) || within(path2, path1), nil
+}
+
+// resolvePath returns the absolute path with symlinks resolved. The part of
+// the path that does not exist yet is kept as it is.
+func resolvePath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	missing := ""
+	for {
+		resolved, err := filepath.EvalSymlinks(abs)
+		if err == nil {
+			return filepath.Join(resolved, missing), nil
+		}
+		parent := filepath.Dir(abs)
+		if !os.IsNotExist(err) || parent == abs {
+			return "", err
+		}
+		missing = filepath.Join(filepath.Base(abs), missing)
+		abs = parent
+	}
+}
+
+// within reports whether path is inside dir.
+func within(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,238 @@
+package scanner
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"sync_dir/internal/plan"
+	"sync_dir/internal/storage"
+	"sync_dir/internal/utils"
+)
+
+// queue hands a new or changed file over to the copy workers, waiting while
+// they are all busy, or only records it in the plan during a dry run.
+func (d *DirScanner) queue(file storage.FilesInfo) {
+	if d.plan == nil {
+		atomic.AddInt64(&d.pending, 1)
+		d.wg.Add(1)
+		if d.storage.AddFileToSync(d.ctx, file, d.wg, d.filesToSync) != nil {
+			atomic.AddInt64(&d.pending, -1)
+		}
+		return
+	}
+	item := plan.Item{
+		Action:     plan.Copy,
+		FileName:   file.FileName,
+		Hash:       file.Hash,
+		HashAlgo:   file.HashAlgo,
+		LinkTarget: file.LinkTarget,
+		HardlinkOf: file.HardlinkOf,
+	}
+	if _, err := os.Lstat(filepath.Join(d.destDir, file.FileName)); err == nil {
+		item.Action = plan.Update
+	}
+	if info, err := os.Stat(file.FilePath); err == nil && file.LinkTarget == "" {
+		item.Size = info.Size()
+	}
+	d.plan.Add(item)
+}
+
+// Plan computes the copies, updates and deletions a sync pass would make
+// without changing the destination directory. Storage changes made while
+// reconciling stay in memory only if the storage is not persistent.
+func (d *DirScanner) Plan() (*plan.Plan, error) {
+	d.plan = plan.New(d.sourceDir, d.destDir)
+	defer func() {
+		d.plan = nil
+		d.moved.used = nil
+	}()
+	visit := d.scanFile
+	if d.opts.Reconcile {
+		visit = d.reconcileFile
+	}
+	if err := d.walk(d.sourceDir, visit); err != nil {
+		return nil, err
+	}
+	for _, file := range d.storage.FindRemoved() {
+		if !d.planMoved(file.FileName) {
+			d.plan.Add(plan.Item{Action: plan.Delete, FileName: file.FileName})
+		}
+	}
+	if d.opts.Reconcile && d.opts.RemoveExtra {
+		if err := d.checkExtraFiles(); err != nil {
+			return nil, err
+		}
+	}
+	result := d.plan
+	result.Sort()
+	return result, nil
+}
+
+// Apply carries out a plan made by Plan for the same directories. Files
+// changed in the source directory since the plan was made are skipped, as
+// are deletions of files that reappeared. The changes are recorded in the
+// index, so the next sync does not make them again, and overwritten or
+// deleted files are kept as versions if versioning is on. Deletions held by
+// the deletion guard are skipped and ErrDeletesHeld is returned.
+func (d *DirScanner) Apply(p *plan.Plan) error {
+	if err := d.samePlanDirs(p); err != nil {
+		return err
+	}
+	defer d.beginPass()()
+	p.Lock()
+	defer p.Unlock()
+	removed := 0
+	for _, item := range p.Items {
+		if item.Action != plan.Delete {
+			continue
+		}
+		if _, err := os.Lstat(filepath.Join(d.sourceDir, item.FileName)); os.IsNotExist(err) {
+			removed++
+		}
+	}
+	allowDeletes := d.allowDeletes(d.storage.Len(), deletes{dir: d.sourceDir, count: removed})
+	failed := 0
+	for _, item := range p.Items {
+		if item.Action == plan.Delete && !allowDeletes {
+			continue
+		}
+		if err := d.applyItem(item); err != nil {
+			d.logger.Errorf("Can't %v %v: %v", item.Action, item.FileName, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%v of %v plan actions failed", failed, len(p.Items))
+	}
+	if !allowDeletes {
+		return fmt.Errorf("%w: %v", ErrDeletesHeld, d.DeletesHeld())
+	}
+	return nil
+}
+
+// samePlanDirs refuses a plan made for other directories.
+func (d *DirScanner) samePlanDirs(p *plan.Plan) error {
+	for _, dirs := range [][2]string{{p.SourceDir, d.sourceDir}, {p.DestDir, d.destDir}} {
+		planned, err := filepath.Abs(dirs[0])
+		if err != nil {
+			return err
+		}
+		dir, err := filepath.Abs(dirs[1])
+		if err != nil {
+			return err
+		}
+		if planned != dir {
+			return fmt.Errorf("the plan was made for %v, not %v", planned, dir)
+		}
+	}
+	return nil
+}
+
+func (d *DirScanner) applyItem(item plan.Item) error {
+	src := filepath.Join(d.sourceDir, item.FileName)
+	dst := filepath.Join(d.destDir, item.FileName)
+	if item.Action == plan.Delete {
+		if _, err := os.Lstat(src); err == nil {
+			d.logger.Warnf("Skip deletion of %v, it exists in the source directory again", item.FileName)
+			return nil
+		}
+		if err := d.removeDest(item.FileName); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		d.storage.Forget(item.FileName)
+		d.logger.Infof("Delete file %v from destination directory", item.FileName)
+		return nil
+	}
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	switch item.Action {
+	case plan.Metadata:
+		if err = utils.CopyMetadata(src, dst, d.opts.Preserve); err != nil {
+			return err
+		}
+		if file, ok := d.storage.GetFile(item.FileName); ok {
+			file.Metadata = d.metadata(src, info)
+			file.LastModified = info.ModTime()
+			d.storage.PutFile(file)
+		}
+		d.logger.Infof("Update metadata of file %v", item.FileName)
+		return nil
+	case plan.Copy, plan.Update, plan.Move:
+		return d.applyCopy(item, src, dst, info)
+	}
+	return fmt.Errorf("unknown action %q", item.Action)
+}
+
+// applyCopy copies, updates or moves a file as planned and records it in
+// the index as synced.
+func (d *DirScanner) applyCopy(item plan.Item, src, dst string, info os.FileInfo) error {
+	if changed, err := item.Changed(src); err != nil || changed {
+		if err == nil {
+			d.logger.Warnf("Skip %v, it changed since the plan was made", item.FileName)
+		}
+		return err
+	}
+	file := storage.FilesInfo{
+		FileName:     item.FileName,
+		FilePath:     src,
+		Hash:         item.Hash,
+		HashAlgo:     item.HashAlgo,
+		LastModified: info.ModTime(),
+		Metadata:     d.metadata(src, info),
+		LinkTarget:   item.LinkTarget,
+		HardlinkOf:   item.HardlinkOf,
+	}
+	if item.LinkTarget == "" && item.HardlinkOf == "" && (file.Hash == "" || file.HashAlgo != d.hasher().Name()) {
+		hash, err := d.hasher().Sum(src)
+		if err != nil {
+			return err
+		}
+		file.Hash, file.HashAlgo = hash, d.hasher().Name()
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if item.Action == plan.Move {
+		moved, err := d.applyMove(item, file, dst)
+		if moved || err != nil {
+			return err
+		}
+	}
+	file.Status = storage.InSync
+	d.storage.PutFile(file)
+	if err := d.copy(item.FileName, src, dst, info); err != nil {
+		d.fail(file, err)
+		return err
+	}
+	file.Status = storage.Sync
+	d.storage.PutFile(file)
+	return nil
+}
+
+// applyMove renames the destination copy of the old name of a moved file.
+// It reports false if the old copy is gone and the file has to be copied.
+func (d *DirScanner) applyMove(item plan.Item, file storage.FilesInfo, dst string) (bool, error) {
+	if d.opts.Versions != nil {
+		if err := d.opts.Versions.Save(item.FileName); err != nil {
+			return false, err
+		}
+	}
+	err := os.Rename(filepath.Join(d.destDir, item.From), dst)
+	if os.IsNotExist(err) {
+		d.logger.Warnf("Copy %v, %v is gone from the destination directory", item.FileName, item.From)
+		d.storage.Forget(item.From)
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err = utils.CopyMetadata(file.FilePath, dst, d.opts.Preserve); err != nil {
+		d.logger.Warnf("Can't copy metadata of %v: %v", item.FileName, err)
+	}
+	d.storage.Rename(item.From, file)
+	d.logger.Infof("Move file %v to %v in destination directory", item.From, item.FileName)
+	return true, nil
+}
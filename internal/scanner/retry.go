@@ -0,0 +1,148 @@
+package scanner
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"sync_dir/internal/storage"
+	"time"
+)
+
+const (
+	defaultRetryAttempts = 5
+	defaultRetryDelay    = time.Second
+	defaultRetryMaxDelay = 5 * time.Minute
+)
+
+// fail records a failed attempt to sync the file and schedules the next one
+// with exponential backoff, or gives the file up after RetryAttempts attempts.
+func (d *DirScanner) fail(file storage.FilesInfo, err error) {
+	file.Attempts++
+	var nextRetry time.Time
+	if file.Attempts < d.retryAttempts() {
+		nextRetry = time.Now().Add(d.backoff(file.Attempts))
+	}
+	d.storage.MarkFailed(file, err, nextRetry)
+	select {
+	case d.failures <- struct{}{}:
+	default:
+	}
+}
+
+func (d *DirScanner) retryAttempts() int {
+	if d.opts.RetryAttempts > 0 {
+		return d.opts.RetryAttempts
+	}
+	return defaultRetryAttempts
+}
+
+// backoff returns the delay before the retry following the given attempt:
+// RetryDelay doubled for every previous attempt, capped at RetryMaxDelay,
+// with random jitter of up to a half of it, so files failing together are
+// not retried all at once.
+func (d *DirScanner) backoff(attempt int) time.Duration {
+	delay, maxDelay := d.opts.RetryDelay, d.opts.RetryMaxDelay
+	if delay <= 0 {
+		delay = defaultRetryDelay
+	}
+	if maxDelay <= 0 {
+		maxDelay = defaultRetryMaxDelay
+	}
+	for i := 1; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// retryDue reports whether a file found by a scan has to be synced: files
+// waiting for a retry are skipped until it is due, abandoned files until the
+// source file changes.
+func retryDue(file storage.FilesInfo, info fs.FileInfo) bool {
+	switch file.Status {
+	case storage.Failed:
+		return !time.Now().Before(file.NextRetry)
+	case storage.Abandoned:
+		return info.ModTime().After(file.LastModified)
+	}
+	return true
+}
+
+// nextRetry returns the time the earliest failed file is due for a retry.
+func (d *DirScanner) nextRetry() (time.Time, bool) {
+	var next time.Time
+	found := false
+	for _, file := range d.storage.Failed() {
+		if file.Status == storage.Failed && (!found || file.NextRetry.Before(next)) {
+			next, found = file.NextRetry, true
+		}
+	}
+	return next, found
+}
+
+// retryDueFiles syncs failed files whose retry is due.
+func (d *DirScanner) retryDueFiles() error {
+	defer d.wg.Done()
+	now := time.Now()
+	for _, file := range d.storage.Failed() {
+		if file.Status != storage.Failed || file.NextRetry.After(now) {
+			continue
+		}
+		d.logger.Infof("Retry file %v, attempt %v", file.FileName, file.Attempts+1)
+		d.wg.Add(1)
+		if err := d.SyncPath(file.FilePath); err != nil {
+			d.logger.Warnf("Can't retry file %v: %v", file.FileName, err)
+		}
+		// A file the walk did not visit, e.g. an excluded one, would stay due
+		// forever, so it counts as a failed attempt.
+		if after, ok := d.storage.GetFile(file.FileName); ok && after.Status == storage.Failed && after.NextRetry.Equal(file.NextRetry) {
+			d.fail(after, errors.New("file was not found by the retry scan"))
+		}
+	}
+	return nil
+}
+
+// scheduleRetry sets timer to fire when the earliest failed file is due.
+func (d *DirScanner) scheduleRetry(timer *time.Timer) {
+	next, ok := d.nextRetry()
+	if !ok {
+		return
+	}
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	timer.Reset(time.Until(next))
+}
+
+// RetryFailed retries failed files as they become due until each of them is
+// synced or given up. Returns an error if some files are left failed.
+func (d *DirScanner) RetryFailed() error {
+	for {
+		next, ok := d.nextRetry()
+		if !ok {
+			break
+		}
+		select {
+		case <-d.ctx.Done():
+			return d.ctx.Err()
+		case <-time.After(time.Until(next)):
+		}
+		err := d.pass(func() error {
+			d.wg.Add(1)
+			return d.retryDueFiles()
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if failed := len(d.storage.Failed()); failed > 0 {
+		return fmt.Errorf("%v files failed to sync", failed)
+	}
+	return nil
+}
@@ -1,9 +1,21 @@
 package scanner
 
+import "sync_dir/internal/storage"
+
 type FileScanner interface {
 	Run()
 	Wait()
 	Close() error
 	CopyFile(fileName string) error
 	ScanDir() error
+	Reconcile() error
+	SyncOnce() error
+	Verify(repair bool) ([]storage.Drift, error)
+	ScanNow()
+	Pause()
+	Resume()
+	Paused() bool
+	Drain() error
+	DeletesHeld() error
+	AcknowledgeDeletes()
 }
@@ -2,11 +2,23 @@ package scanner
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/sirupsen/logrus"
+	"io/fs"
+	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
 	"sync"
+	"sync/atomic"
+	"sync_dir/internal/ignore"
+	"sync_dir/internal/plan"
 	"sync_dir/internal/storage"
 	"sync_dir/internal/storage/generated_storage"
+	"sync_dir/internal/utils"
+	"sync_dir/internal/versions"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -233,3 +245,1565 @@ func TestNewDirScanner(t *testing.T) {
 		})
 	}
 }
+
+func TestDirScanner_ScanDirNested(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+	}{
+		{name: "same base name", files: []string{"a/report.txt", "b/report.txt"}},
+		{name: "deep tree", files: []string{"1.txt", "a/b/c/2.txt"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srcDir, dstDir := t.TempDir(), t.TempDir()
+			for _, name := range tt.files {
+				writeFile(t, filepath.Join(srcDir, name), name)
+			}
+			files := make(chan string, len(tt.files))
+			d := &DirScanner{
+				wg:          &sync.WaitGroup{},
+				ctx:         context.Background(),
+				sourceDir:   srcDir,
+				destDir:     dstDir,
+				logger:      logger,
+				storage:     generated_storage.NewStorageWithLogrus(storage.NewFileStorage(map[string]storage.FilesInfo{}, logger), logger),
+				filesToSync: files,
+				syncDone:    make(chan string, len(tt.files)),
+			}
+			d.wg.Add(1)
+			if err := d.ScanDir(); err != nil {
+				t.Fatalf("ScanDir() error = %v", err)
+			}
+			d.Wait()
+			close(files)
+			for fileName := range files {
+				d.wg.Add(1)
+				if err := d.CopyFile(fileName); err != nil {
+					t.Errorf("CopyFile(%v) error = %v", fileName, err)
+				}
+			}
+			for _, name := range tt.files {
+				name = filepath.FromSlash(name)
+				if _, ok := d.storage.GetFile(name); !ok {
+					t.Errorf("GetFile(%v) not found", name)
+				}
+				if got, err := os.ReadFile(filepath.Join(dstDir, name)); err != nil || string(got) != filepath.ToSlash(name) {
+					t.Errorf("destination %v = %q, %v", name, got, err)
+				}
+			}
+		})
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDebounce(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []string
+		gap    time.Duration
+		want   int
+	}{
+		{name: "single event", events: []string{"1.txt"}, want: 1},
+		{name: "burst with duplicates", events: []string{"1.txt", "1.txt", "2.txt", "1.txt"}, want: 2},
+		{name: "steady stream", events: []string{"1.txt", "1.txt", "1.txt", "1.txt", "1.txt", "1.txt", "1.txt", "1.txt"}, gap: 8 * time.Millisecond, want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events := make(chan string)
+			batches := debounce(nil, events, 10*time.Millisecond, 30*time.Millisecond)
+			sent := make(chan struct{})
+			go func() {
+				defer close(sent)
+				for _, event := range tt.events {
+					events <- event
+					time.Sleep(tt.gap)
+				}
+			}()
+			if got := <-batches; len(got) != tt.want {
+				t.Errorf("debounce() batch = %v, want %v paths", got, tt.want)
+			}
+			select {
+			case <-sent:
+				if tt.gap > 0 {
+					t.Errorf("debounce() held the batch until the events stopped")
+				}
+			default:
+			}
+			drained := make(chan struct{})
+			go func() {
+				defer close(drained)
+				for range batches {
+				}
+			}()
+			<-sent
+			close(events)
+			<-drained
+		})
+	}
+	events := make(chan string, 1)
+	done := make(chan struct{})
+	batches := debounce(done, events, 10*time.Millisecond, 30*time.Millisecond)
+	events <- "1.txt"
+	close(done)
+	time.Sleep(20 * time.Millisecond)
+	close(events)
+	if _, ok := <-batches; ok {
+		t.Errorf("debounce() batches not closed when done")
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	root := t.TempDir()
+	w, err := NewWatcher(root, logger)
+	if err != nil {
+		t.Skipf("NewWatcher() error = %v", err)
+	}
+	defer w.Close()
+	tests := []struct {
+		name   string
+		change func()
+		want   string
+	}{
+		{name: "create file", change: func() { writeFile(t, filepath.Join(root, "1.txt"), "1") }, want: filepath.Join(root, "1.txt")},
+		{name: "create directory", change: func() { os.Mkdir(filepath.Join(root, "a"), 0755) }, want: filepath.Join(root, "a")},
+		{name: "file in new directory", change: func() { writeFile(t, filepath.Join(root, "a", "2.txt"), "2") }, want: filepath.Join(root, "a", "2.txt")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.change()
+			timeout := time.After(5 * time.Second)
+			for {
+				select {
+				case got := <-w.Events:
+					if got == tt.want {
+						return
+					}
+				case <-timeout:
+					t.Fatalf("no event for %v", tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestDirScanner_Reconcile(t *testing.T) {
+	tests := []struct {
+		name        string
+		src         map[string]string
+		dst         map[string]string
+		removeExtra bool
+		wantCopy    []string
+		wantDst     map[string]bool
+	}{
+		{name: "identical copy", src: map[string]string{"1.txt": "1"}, dst: map[string]string{"1.txt": "1"}, wantDst: map[string]bool{"1.txt": true}},
+		{name: "missing and different", src: map[string]string{"1.txt": "1", "a/2.txt": "2"}, dst: map[string]string{"1.txt": "old"}, wantCopy: []string{"1.txt", filepath.Join("a", "2.txt")}},
+		{name: "keep extra", src: map[string]string{}, dst: map[string]string{"3.txt": "3"}, wantDst: map[string]bool{"3.txt": true}},
+		{name: "remove extra", src: map[string]string{}, dst: map[string]string{"3.txt": "3"}, removeExtra: true, wantDst: map[string]bool{"3.txt": false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srcDir, dstDir := t.TempDir(), t.TempDir()
+			for name, content := range tt.src {
+				writeFile(t, filepath.Join(srcDir, name), content)
+			}
+			for name, content := range tt.dst {
+				writeFile(t, filepath.Join(dstDir, name), content)
+			}
+			files := make(chan string, len(tt.src))
+			d := &DirScanner{
+				wg:          &sync.WaitGroup{},
+				ctx:         context.Background(),
+				sourceDir:   srcDir,
+				destDir:     dstDir,
+				logger:      logger,
+				storage:     generated_storage.NewStorageWithLogrus(storage.NewFileStorage(map[string]storage.FilesInfo{}, logger), logger),
+				filesToSync: files,
+				opts:        Options{Reconcile: true, RemoveExtra: tt.removeExtra},
+			}
+			d.wg.Add(1)
+			if err := d.Reconcile(); err != nil {
+				t.Fatalf("Reconcile() error = %v", err)
+			}
+			d.Wait()
+			close(files)
+			copied := map[string]bool{}
+			for fileName := range files {
+				copied[fileName] = true
+			}
+			if len(copied) != len(tt.wantCopy) {
+				t.Errorf("Reconcile() queued %v, want %v", copied, tt.wantCopy)
+			}
+			for _, name := range tt.wantCopy {
+				if !copied[name] {
+					t.Errorf("Reconcile() did not queue %v", name)
+				}
+			}
+			for name, want := range tt.wantDst {
+				if _, err := os.Stat(filepath.Join(dstDir, name)); (err == nil) != want {
+					t.Errorf("destination %v exists = %v, want %v", name, err == nil, want)
+				}
+				if file, ok := d.storage.GetFile(name); want && tt.src[name] != "" && (!ok || file.Status != storage.Sync) {
+					t.Errorf("GetFile(%v) = %v, %v, want synced file", name, file, ok)
+				}
+			}
+		})
+	}
+}
+
+func TestDirScanner_ReconcileNextPass(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	for _, name := range []string{"1.txt", filepath.Join("a", "2.txt")} {
+		writeFile(t, filepath.Join(srcDir, name), name)
+		writeFile(t, filepath.Join(dstDir, name), name)
+	}
+	writeFile(t, filepath.Join(srcDir, "3.txt"), "new")
+	writeFile(t, filepath.Join(dstDir, "3.txt"), "old")
+	d := newTestScanner(srcDir, dstDir)
+	d.opts = Options{Reconcile: true, Preserve: utils.Preserve{Mode: true, Times: true}}
+	if err := d.SyncOnce(); err != nil {
+		t.Fatalf("SyncOnce() error = %v", err)
+	}
+	d.opts.Reconcile = false
+	p, err := d.Plan()
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+	if len(p.Items) != 0 {
+		t.Errorf("Plan() after reconciling = %+v, want no items", p.Items)
+	}
+}
+
+func TestDirScanner_InternalDirs(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	nested := []string{filepath.Join("a", storage.IndexDirName, "1.txt"), filepath.Join("a", versions.DirName, "2.txt")}
+	for _, name := range nested {
+		writeFile(t, filepath.Join(srcDir, name), name)
+	}
+	writeFile(t, filepath.Join(dstDir, "b", versions.DirName, "extra.txt"), "extra")
+	own := []string{filepath.Join(storage.IndexDirName, "index.json"), filepath.Join(versions.DirName, "1.txt")}
+	for _, name := range own {
+		writeFile(t, filepath.Join(dstDir, name), name)
+	}
+	d := newTestScanner(srcDir, dstDir)
+	d.opts = Options{Reconcile: true, RemoveExtra: true}
+	if err := d.SyncOnce(); err != nil {
+		t.Fatalf("SyncOnce() error = %v", err)
+	}
+	for _, name := range append(nested, own...) {
+		if got, err := os.ReadFile(filepath.Join(dstDir, name)); err != nil || string(got) != name {
+			t.Errorf("%v = %q, %v, want %q", name, got, err, name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dstDir, "b", versions.DirName, "extra.txt")); !os.IsNotExist(err) {
+		t.Errorf("extra file in a nested %v directory was not removed", versions.DirName)
+	}
+	drifts, err := d.Verify(false)
+	if err != nil || len(drifts) != 0 {
+		t.Errorf("Verify() = %+v, %v, want no drifts", drifts, err)
+	}
+}
+
+type failingHasher struct {
+	err error
+}
+
+func (h failingHasher) Name() string {
+	return "md5"
+}
+
+func (h failingHasher) Sum(path string) (string, error) {
+	return "", h.err
+}
+
+func TestDirScanner_ScanDirHashErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus storage.Status
+		wantStored bool
+	}{
+		{name: "unreadable file", err: errors.New("permission denied"), wantStatus: storage.Failed, wantStored: true},
+		{name: "vanished file", err: fs.ErrNotExist, wantStored: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srcDir := t.TempDir()
+			writeFile(t, filepath.Join(srcDir, "1.txt"), "1")
+			files := make(chan string, 1)
+			d := &DirScanner{
+				wg:          &sync.WaitGroup{},
+				ctx:         context.Background(),
+				sourceDir:   srcDir,
+				destDir:     t.TempDir(),
+				logger:      logger,
+				storage:     generated_storage.NewStorageWithLogrus(storage.NewFileStorage(map[string]storage.FilesInfo{}, logger), logger),
+				filesToSync: files,
+				opts:        Options{Hasher: failingHasher{err: tt.err}, RetryDelay: time.Millisecond},
+			}
+			d.wg.Add(1)
+			if err := d.ScanDir(); err != nil {
+				t.Fatalf("ScanDir() error = %v", err)
+			}
+			file, ok := d.storage.GetFile("1.txt")
+			if ok != tt.wantStored || file.Status != tt.wantStatus {
+				t.Fatalf("GetFile() = %v, %v, want status %v stored %v", file, ok, tt.wantStatus, tt.wantStored)
+			}
+			time.Sleep(2 * time.Millisecond)
+			d.opts.Hasher = nil
+			d.wg.Add(1)
+			if err := d.ScanDir(); err != nil {
+				t.Fatalf("ScanDir() retry error = %v", err)
+			}
+			d.Wait()
+			if got := <-files; got != "1.txt" {
+				t.Errorf("ScanDir() retry queued %v, want 1.txt", got)
+			}
+		})
+	}
+}
+
+func TestDirScanner_ScanDirMetadataOnly(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(srcDir, "run.sh"), "#!/bin/sh")
+	files := make(chan string, 1)
+	d := &DirScanner{
+		wg:          &sync.WaitGroup{},
+		ctx:         context.Background(),
+		sourceDir:   srcDir,
+		destDir:     dstDir,
+		logger:      logger,
+		storage:     generated_storage.NewStorageWithLogrus(storage.NewFileStorage(map[string]storage.FilesInfo{}, logger), logger),
+		filesToSync: files,
+		syncDone:    make(chan string, 1),
+		opts:        Options{Preserve: utils.Preserve{Mode: true}},
+	}
+	d.wg.Add(1)
+	if err := d.ScanDir(); err != nil {
+		t.Fatalf("ScanDir() error = %v", err)
+	}
+	d.Wait()
+	d.wg.Add(2)
+	d.CopyFile(<-files)
+	d.storage.ChangeStatusToSync(<-d.syncDone, d.wg)
+	tests := []struct {
+		name string
+		mode os.FileMode
+	}{
+		{name: "chmod +x", mode: 0755},
+		{name: "chmod -x", mode: 0600},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := os.Chmod(filepath.Join(srcDir, "run.sh"), tt.mode); err != nil {
+				t.Fatal(err)
+			}
+			d.wg.Add(1)
+			if err := d.ScanDir(); err != nil {
+				t.Fatalf("ScanDir() error = %v", err)
+			}
+			d.Wait()
+			if len(files) != 0 {
+				t.Errorf("ScanDir() queued %v for copying", <-files)
+			}
+			info, err := os.Stat(filepath.Join(dstDir, "run.sh"))
+			if err != nil || info.Mode().Perm() != tt.mode {
+				t.Errorf("destination mode = %v, %v, want %v", info.Mode().Perm(), err, tt.mode)
+			}
+		})
+	}
+}
+
+func TestDirScanner_Links(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      LinkPolicy
+		wantSymlink bool
+		wantFollow  bool
+		wantWritten int64
+	}{
+		{name: "copy", policy: LinkCopy, wantSymlink: true, wantWritten: 2},
+		{name: "follow", policy: LinkFollow, wantFollow: true, wantWritten: 4},
+		{name: "skip", policy: LinkSkip, wantWritten: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srcDir, dstDir := t.TempDir(), t.TempDir()
+			writeFile(t, filepath.Join(srcDir, "1.txt"), "1")
+			writeFile(t, filepath.Join(srcDir, "a", "2.txt"), "2")
+			if err := os.Symlink("1.txt", filepath.Join(srcDir, "link.txt")); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Symlink("a", filepath.Join(srcDir, "link")); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Symlink(".", filepath.Join(srcDir, "a", "loop")); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Link(filepath.Join(srcDir, "1.txt"), filepath.Join(srcDir, "hard.txt")); err != nil {
+				t.Fatal(err)
+			}
+			if err := syscall.Mkfifo(filepath.Join(srcDir, "fifo"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			d := newTestScanner(srcDir, dstDir)
+			d.opts.Symlinks = tt.policy
+			syncAll(t, d)
+			syncAll(t, d)
+
+			target, err := os.Readlink(filepath.Join(dstDir, "link.txt"))
+			if (err == nil) != tt.wantSymlink || tt.wantSymlink && target != "1.txt" {
+				t.Errorf("symlink link.txt = %v, %v, want symlink %v", target, err, tt.wantSymlink)
+			}
+			if info, err := os.Lstat(filepath.Join(dstDir, "link")); (err == nil && info.IsDir()) != tt.wantFollow {
+				t.Errorf("followed directory link exists = %v, want %v", err == nil && info.IsDir(), tt.wantFollow)
+			}
+			if _, err = os.Lstat(filepath.Join(dstDir, "a", "loop")); tt.wantFollow && err == nil {
+				t.Errorf("symlink loop a/loop was followed")
+			}
+			if !utils.SameFile(filepath.Join(dstDir, "1.txt"), filepath.Join(dstDir, "hard.txt")) {
+				t.Errorf("hard.txt is not a hard link to 1.txt")
+			}
+			if _, err = os.Lstat(filepath.Join(dstDir, "fifo")); err == nil {
+				t.Errorf("fifo was copied")
+			}
+			if stats := d.Stats(); stats.SpecialSkipped == 0 || stats.Hardlinks == 0 {
+				t.Errorf("Stats() = %+v", stats)
+			}
+			if got := d.Written(); got != tt.wantWritten {
+				t.Errorf("Written() = %v, want %v", got, tt.wantWritten)
+			}
+		})
+	}
+}
+
+func newTestScanner(srcDir, dstDir string) *DirScanner {
+	return &DirScanner{
+		wg:          &sync.WaitGroup{},
+		ctx:         context.Background(),
+		sourceDir:   srcDir,
+		destDir:     dstDir,
+		logger:      logger,
+		storage:     generated_storage.NewStorageWithLogrus(storage.NewFileStorage(map[string]storage.FilesInfo{}, logger), logger),
+		filesToSync: make(chan string, 100),
+		syncDone:    make(chan string, 100),
+		progress:    make(chan struct{}, 1),
+	}
+}
+
+// syncAll runs one scan and copies everything it queued, one file at a time.
+func syncAll(t *testing.T, d *DirScanner) {
+	d.wg.Add(1)
+	if err := d.ScanDir(); err != nil {
+		t.Fatalf("ScanDir() error = %v", err)
+	}
+	d.Wait()
+	for len(d.filesToSync) > 0 {
+		fileName := <-d.filesToSync
+		d.wg.Add(1)
+		if err := d.CopyFile(fileName); err != nil {
+			t.Errorf("CopyFile(%v) error = %v", fileName, err)
+		}
+		d.wg.Add(1)
+		d.storage.ChangeStatusToSync(<-d.syncDone, d.wg)
+	}
+}
+
+func TestDirScanner_ScanDirIgnore(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	files := map[string]bool{
+		"1.txt":             true,
+		"1.tmp":             false,
+		".git/config":       false,
+		"a/2.txt":           true,
+		"a/2.log":           false,
+		"a/keep.log":        true,
+		"a/b/3.log":         false,
+		"build/out.bin":     false,
+		"c/build/out.bin":   true,
+		"c/.syncignore":     true,
+		"c/generated.go":    false,
+		"a/.syncignore":     true,
+		"main.go.swp":       false,
+		"other/main.go":     true,
+		"other/.main.swp":   false,
+		"other/.syncignore": true,
+	}
+	contents := map[string]string{
+		"a/.syncignore":     "*.log\n!keep.log\n",
+		"c/.syncignore":     "generated.go\n",
+		"other/.syncignore": ".*.swp\n",
+	}
+	for name := range files {
+		writeFile(t, filepath.Join(srcDir, name), contents[name])
+	}
+	writeFile(t, filepath.Join(srcDir, ignore.FileName), "*.swp\n/build/\n")
+	d := newTestScanner(srcDir, dstDir)
+	d.opts.Ignore = []string{"*.tmp", ".git/"}
+	syncAll(t, d)
+	for name, want := range files {
+		name = filepath.FromSlash(name)
+		if _, err := os.Stat(filepath.Join(dstDir, name)); (err == nil) != want {
+			t.Errorf("%v copied = %v, want %v", name, err == nil, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dstDir, ".git")); err == nil {
+		t.Errorf(".git directory was created")
+	}
+
+	writeFile(t, filepath.Join(srcDir, "a", "b", "4.log"), "4")
+	writeFile(t, filepath.Join(srcDir, "a", "b", "4.txt"), "4")
+	for _, path := range []string{filepath.Join(srcDir, "a", "b", "4.log"), filepath.Join(srcDir, "a", "b", "4.txt")} {
+		d.wg.Add(1)
+		if err := d.SyncPath(path); err != nil {
+			t.Fatalf("SyncPath() error = %v", err)
+		}
+	}
+	d.Wait()
+	if len(d.filesToSync) != 1 || <-d.filesToSync != filepath.Join("a", "b", "4.txt") {
+		t.Errorf("SyncPath() should queue only a/b/4.txt")
+	}
+}
+
+func TestDirScanner_Plan(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(srcDir, "1.txt"), "1")
+	writeFile(t, filepath.Join(srcDir, "a", "2.txt"), "2")
+	writeFile(t, filepath.Join(dstDir, "1.txt"), "old")
+	writeFile(t, filepath.Join(dstDir, "3.txt"), "3")
+	d := newTestScanner(srcDir, dstDir)
+	d.storage.PutFile(storage.FilesInfo{FileName: "4.txt", FilePath: filepath.Join(srcDir, "4.txt"), Status: storage.Sync})
+	d.opts = Options{Reconcile: true, RemoveExtra: true}
+	p, err := d.Plan()
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+	want := map[string]plan.Action{
+		"1.txt":                     plan.Update,
+		filepath.Join("a", "2.txt"): plan.Copy,
+		"3.txt":                     plan.Delete,
+		"4.txt":                     plan.Delete,
+	}
+	if len(p.Items) != len(want) {
+		t.Errorf("Plan() items = %+v, want %v", p.Items, want)
+	}
+	for _, item := range p.Items {
+		if want[item.FileName] != item.Action {
+			t.Errorf("Plan() %v action = %v, want %v", item.FileName, item.Action, want[item.FileName])
+		}
+	}
+	if _, err = os.Stat(filepath.Join(dstDir, "a")); err == nil {
+		t.Errorf("Plan() created directory a")
+	}
+	if got, _ := os.ReadFile(filepath.Join(dstDir, "1.txt")); string(got) != "old" || len(d.filesToSync) != 0 {
+		t.Errorf("Plan() changed the destination")
+	}
+}
+
+func TestDirScanner_Apply(t *testing.T) {
+	tests := []struct {
+		name         string
+		src          map[string]string
+		dst          map[string]string
+		change       func(srcDir, dstDir string)
+		want         map[string]string
+		wantVersions map[string]int
+		wantReplan   int
+		wantErr      bool
+	}{
+		{
+			name: "copy",
+			src:  map[string]string{"a/1.txt": "1"},
+			want: map[string]string{"a/1.txt": "1"},
+		},
+		{
+			name:         "update",
+			src:          map[string]string{"1.txt": "new"},
+			dst:          map[string]string{"1.txt": "old"},
+			want:         map[string]string{"1.txt": "new"},
+			wantVersions: map[string]int{"1.txt": 1},
+		},
+		{
+			name: "skip changed since plan",
+			src:  map[string]string{"1.txt": "new"},
+			change: func(srcDir, dstDir string) {
+				writeFile(t, filepath.Join(srcDir, "1.txt"), "newer")
+			},
+			want:       map[string]string{"1.txt": ""},
+			wantReplan: 1,
+		},
+		{
+			name:         "delete",
+			dst:          map[string]string{"1.txt": "old"},
+			want:         map[string]string{"1.txt": ""},
+			wantVersions: map[string]int{"1.txt": 1},
+		},
+		{
+			name: "skip deletion of reappeared file",
+			dst:  map[string]string{"1.txt": "old"},
+			change: func(srcDir, dstDir string) {
+				writeFile(t, filepath.Join(srcDir, "1.txt"), "back")
+			},
+			want:       map[string]string{"1.txt": "old"},
+			wantReplan: 1,
+		},
+		{
+			name: "move",
+			src:  map[string]string{"b/2.txt": "1"},
+			dst:  map[string]string{"a/1.txt": "1"},
+			want: map[string]string{"b/2.txt": "1", "a/1.txt": ""},
+		},
+		{
+			name: "copy when moved file is gone",
+			src:  map[string]string{"2.txt": "1"},
+			dst:  map[string]string{"1.txt": "1"},
+			change: func(srcDir, dstDir string) {
+				if err := os.Remove(filepath.Join(dstDir, "1.txt")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: map[string]string{"2.txt": "1"},
+		},
+		{
+			name: "missing source",
+			src:  map[string]string{"1.txt": "1"},
+			change: func(srcDir, dstDir string) {
+				if err := os.Remove(filepath.Join(srcDir, "1.txt")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want:    map[string]string{"1.txt": ""},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srcDir, dstDir := t.TempDir(), t.TempDir()
+			for name, content := range tt.src {
+				writeFile(t, filepath.Join(srcDir, name), content)
+			}
+			store := versions.NewStore(dstDir, versions.Policy{})
+			d := newTestScanner(srcDir, dstDir)
+			d.opts = Options{Versions: store}
+			for name, content := range tt.dst {
+				writeFile(t, filepath.Join(dstDir, name), content)
+				hash, err := utils.DefaultHasher().Sum(filepath.Join(dstDir, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				d.storage.PutFile(storage.FilesInfo{FileName: name, FilePath: filepath.Join(srcDir, name), Hash: hash, HashAlgo: "md5", Status: storage.Sync})
+			}
+			p, err := d.Plan()
+			if err != nil {
+				t.Fatalf("Plan() error = %v", err)
+			}
+			if tt.change != nil {
+				tt.change(srcDir, dstDir)
+			}
+			if err = d.Apply(p); (err != nil) != tt.wantErr {
+				t.Fatalf("Apply() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			for name, want := range tt.want {
+				got, err := os.ReadFile(filepath.Join(dstDir, name))
+				if want == "" && !os.IsNotExist(err) || want != "" && string(got) != want {
+					t.Errorf("%v = %q, %v, want %q", name, got, err, want)
+				}
+			}
+			for name, want := range tt.wantVersions {
+				if kept, err := store.List(name); err != nil || len(kept) != want {
+					t.Errorf("%v versions = %v, %v, want %v", name, len(kept), err, want)
+				}
+			}
+			if tt.wantErr {
+				return
+			}
+			if replan, err := d.Plan(); err != nil || len(replan.Items) != tt.wantReplan {
+				t.Errorf("Plan() after Apply() = %+v, %v, want %v items", replan, err, tt.wantReplan)
+			}
+		})
+	}
+}
+
+func TestDirScanner_ApplyOtherDirs(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	d := newTestScanner(srcDir, dstDir)
+	if err := d.Apply(plan.New(srcDir, t.TempDir())); err == nil {
+		t.Errorf("Apply() of a plan for other directories error = nil")
+	}
+}
+
+func TestDirScanner_SyncOnce(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	files := []string{"1.txt", filepath.Join("a", "2.txt"), filepath.Join("a", "b", "3.txt")}
+	for i := 0; i < 20; i++ {
+		files = append(files, filepath.Join("c", fmt.Sprintf("%v.txt", i)))
+	}
+	for _, name := range files {
+		writeFile(t, filepath.Join(srcDir, name), name)
+	}
+	writeFile(t, filepath.Join(dstDir, "extra.txt"), "extra")
+	d := newTestScanner(srcDir, dstDir)
+	d.ctx = context.Background()
+	d.filesToSync, d.syncDone = make(chan string, 2), make(chan string, 2)
+	d.opts = Options{Reconcile: true, RemoveExtra: true}
+	if err := d.SyncOnce(); err != nil {
+		t.Fatalf("SyncOnce() error = %v", err)
+	}
+	for _, name := range files {
+		if got, err := os.ReadFile(filepath.Join(dstDir, name)); err != nil || string(got) != name {
+			t.Errorf("%v = %q, %v", name, got, err)
+		}
+		if file, _ := d.storage.GetFile(name); file.Status != storage.Sync {
+			t.Errorf("%v status = %v, want %v", name, file.Status, storage.Sync)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dstDir, "extra.txt")); !os.IsNotExist(err) {
+		t.Errorf("extra.txt was not removed")
+	}
+	if err := os.Remove(filepath.Join(srcDir, "1.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SyncOnce(); err != nil {
+		t.Fatalf("SyncOnce() error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dstDir, "1.txt")); !os.IsNotExist(err) {
+		t.Errorf("1.txt was not removed")
+	}
+}
+
+func TestDirScanner_SyncOnceAfterRestart(t *testing.T) {
+	srcDir, dstDir, indexDir := t.TempDir(), t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(srcDir, "1.txt"), "new")
+	writeFile(t, filepath.Join(dstDir, "1.txt"), "old")
+	writeFile(t, filepath.Join(dstDir, "2.txt"), "old")
+	index, err := storage.NewPersistentStorage(indexDir, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both files were queued when the previous run stopped, 2.txt was
+	// deleted from the source since.
+	for _, name := range []string{"1.txt", "2.txt"} {
+		index.PutFile(storage.FilesInfo{FileName: name, FilePath: filepath.Join(srcDir, name), Hash: "queued", HashAlgo: "md5", Status: storage.InSync})
+	}
+	if err = index.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if index, err = storage.NewPersistentStorage(indexDir, logger); err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	d := newTestScanner(srcDir, dstDir)
+	d.storage = generated_storage.NewStorageWithLogrus(index, logger)
+	if err = d.SyncOnce(); err != nil {
+		t.Fatalf("SyncOnce() error = %v", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(dstDir, "1.txt")); err != nil || string(got) != "new" {
+		t.Errorf("1.txt = %q, %v, want %q", got, err, "new")
+	}
+	if file, _ := d.storage.GetFile("1.txt"); file.Status != storage.Sync {
+		t.Errorf("1.txt status = %v, want %v", file.Status, storage.Sync)
+	}
+	if _, err = os.Stat(filepath.Join(dstDir, "2.txt")); !os.IsNotExist(err) {
+		t.Errorf("2.txt deleted from the source is left in the destination")
+	}
+	if _, ok := d.storage.GetFile("2.txt"); ok {
+		t.Errorf("2.txt deleted from the source is left in the index")
+	}
+}
+
+func TestDirScanner_SyncOnceVersions(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(srcDir, "a", "1.txt"), "v1")
+	store := versions.NewStore(dstDir, versions.Policy{})
+	d := newTestScanner(srcDir, dstDir)
+	d.ctx = context.Background()
+	d.storage = generated_storage.NewStorageWithLogrus(storage.NewFileStorage(map[string]storage.FilesInfo{}, logger).WithVersions(store), logger)
+	d.opts = Options{Versions: store}
+	steps := []func(){
+		func() {},
+		func() {
+			writeFile(t, filepath.Join(srcDir, "a", "1.txt"), "v2")
+			later := time.Now().Add(time.Minute)
+			if err := os.Chtimes(filepath.Join(srcDir, "a", "1.txt"), later, later); err != nil {
+				t.Fatal(err)
+			}
+		},
+		func() {
+			if err := os.Remove(filepath.Join(srcDir, "a", "1.txt")); err != nil {
+				t.Fatal(err)
+			}
+		},
+	}
+	for _, step := range steps {
+		step()
+		if err := d.SyncOnce(); err != nil {
+			t.Fatalf("SyncOnce() error = %v", err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dstDir, "a", "1.txt")); !os.IsNotExist(err) {
+		t.Errorf("a/1.txt was not removed")
+	}
+	kept, err := store.List(filepath.Join("a", "1.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"v2", "v1"}
+	if len(kept) != len(want) {
+		t.Fatalf("kept %v versions, want %v", len(kept), len(want))
+	}
+	for i, version := range kept {
+		if got, err := os.ReadFile(version.Path); err != nil || string(got) != want[i] {
+			t.Errorf("version %v = %q, %v, want %q", i, got, err, want[i])
+		}
+	}
+}
+
+func TestDirScanner_PruneVersions(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(dstDir, "1.txt"), "1")
+	store := versions.NewStore(dstDir, versions.Policy{KeepFor: time.Millisecond})
+	d := newTestScanner(srcDir, dstDir)
+	d.opts = Options{Versions: store}
+	tests := []struct {
+		name       string
+		lastPruned int64
+		wantKept   int
+	}{
+		{name: "first scan", wantKept: 0},
+		{name: "pruned recently", lastPruned: time.Now().UnixNano(), wantKept: 1},
+		{name: "pruned an hour ago", lastPruned: time.Now().Add(-pruneInterval).UnixNano(), wantKept: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := store.Save("1.txt"); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(10 * time.Millisecond)
+			d.pruned = tt.lastPruned
+			d.pruneVersions()
+			kept, err := store.List("1.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(kept) != tt.wantKept {
+				t.Errorf("kept %v versions, want %v", len(kept), tt.wantKept)
+			}
+		})
+	}
+}
+
+func TestDirScanner_SyncOnceMoves(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(srcDir, "a", "big.bin"), "big")
+	writeFile(t, filepath.Join(srcDir, "a", "twin1.txt"), "twin")
+	writeFile(t, filepath.Join(srcDir, "a", "twin2.txt"), "twin")
+	writeFile(t, filepath.Join(srcDir, "keep.txt"), "keep")
+	d := newTestScanner(srcDir, dstDir)
+	d.ctx = context.Background()
+	if err := d.SyncOnce(); err != nil {
+		t.Fatalf("SyncOnce() error = %v", err)
+	}
+	before, err := os.Stat(filepath.Join(dstDir, "a", "big.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	moves := map[string]string{
+		filepath.Join("a", "big.bin"):   filepath.Join("b", "c", "moved.bin"),
+		filepath.Join("a", "twin1.txt"): filepath.Join("b", "twin1.txt"),
+		filepath.Join("a", "twin2.txt"): filepath.Join("b", "twin2.txt"),
+	}
+	for from, to := range moves {
+		if err = os.MkdirAll(filepath.Dir(filepath.Join(srcDir, to)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Rename(filepath.Join(srcDir, from), filepath.Join(srcDir, to)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p, err := d.Plan()
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+	if moved := p.Count(plan.Move); moved != 3 || len(p.Items) != 3 {
+		t.Errorf("Plan() items = %+v, want 3 moves", p.Items)
+	}
+	if err = d.SyncOnce(); err != nil {
+		t.Fatalf("SyncOnce() error = %v", err)
+	}
+	after, err := os.Stat(filepath.Join(dstDir, "b", "c", "moved.bin"))
+	if err != nil || !os.SameFile(before, after) {
+		t.Errorf("b/c/moved.bin was not renamed from a/big.bin: %v", err)
+	}
+	for from, to := range moves {
+		if _, err = os.Lstat(filepath.Join(dstDir, from)); !os.IsNotExist(err) {
+			t.Errorf("%v is left in the destination", from)
+		}
+		if _, ok := d.storage.GetFile(from); ok {
+			t.Errorf("%v is left in the index", from)
+		}
+		if file, _ := d.storage.GetFile(to); file.Status != storage.Sync {
+			t.Errorf("%v status = %v, want %v", to, file.Status, storage.Sync)
+		}
+		want, _ := os.ReadFile(filepath.Join(srcDir, to))
+		if got, err := os.ReadFile(filepath.Join(dstDir, to)); err != nil || string(got) != string(want) {
+			t.Errorf("%v = %q, %v, want %q", to, got, err, want)
+		}
+	}
+}
+
+func TestDirScanner_SyncOnceTwoWay(t *testing.T) {
+	synced := time.Now().Add(-time.Hour)
+	type change struct {
+		dir     string
+		content string
+		// age is how long before now the change was made, empty content
+		// removes the file.
+		age time.Duration
+	}
+	tests := []struct {
+		name   string
+		policy ConflictPolicy
+		// fresh tests start without the file.
+		fresh     bool
+		changes   []change
+		want      string
+		conflicts string
+	}{
+		{name: "new in source", fresh: true, changes: []change{{dir: "src", content: "new"}}, want: "new"},
+		{name: "new in destination", fresh: true, changes: []change{{dir: "dst", content: "new"}}, want: "new"},
+		{name: "modified in destination", changes: []change{{dir: "dst", content: "edit"}}, want: "edit"},
+		{name: "deleted in destination", changes: []change{{dir: "dst"}}, want: ""},
+		{name: "deleted in source", changes: []change{{dir: "src"}}, want: ""},
+		{name: "modified and deleted", changes: []change{{dir: "src", content: "edit"}, {dir: "dst"}}, want: "edit"},
+		{
+			name:    "newest wins",
+			policy:  ConflictNewest,
+			changes: []change{{dir: "src", content: "old edit", age: 2 * time.Minute}, {dir: "dst", content: "new edit", age: time.Minute}},
+			want:    "new edit",
+		},
+		{
+			name:    "source wins",
+			policy:  ConflictSource,
+			changes: []change{{dir: "src", content: "old edit", age: 2 * time.Minute}, {dir: "dst", content: "new edit", age: time.Minute}},
+			want:    "old edit",
+		},
+		{
+			name:      "keep both",
+			policy:    ConflictKeepBoth,
+			changes:   []change{{dir: "src", content: "source edit"}, {dir: "dst", content: "destination edit"}},
+			want:      "source edit",
+			conflicts: "destination edit",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dirs := map[string]string{"src": t.TempDir(), "dst": t.TempDir()}
+			d := newTestScanner(dirs["src"], dirs["dst"])
+			d.ctx = context.Background()
+			d.opts = Options{TwoWay: true, Conflicts: tt.policy, Preserve: utils.Preserve{Times: true}}
+			path := filepath.Join("a", "f.txt")
+			if !tt.fresh {
+				writeFile(t, filepath.Join(dirs["src"], path), "synced")
+				if err := os.Chtimes(filepath.Join(dirs["src"], path), synced, synced); err != nil {
+					t.Fatal(err)
+				}
+				if err := d.SyncOnce(); err != nil {
+					t.Fatalf("SyncOnce() error = %v", err)
+				}
+			}
+			for _, change := range tt.changes {
+				changed := filepath.Join(dirs[change.dir], path)
+				if change.content == "" {
+					if err := os.Remove(changed); err != nil {
+						t.Fatal(err)
+					}
+					continue
+				}
+				writeFile(t, changed, change.content)
+				modified := time.Now().Add(-change.age)
+				if err := os.Chtimes(changed, modified, modified); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := d.SyncOnce(); err != nil {
+				t.Fatalf("SyncOnce() error = %v", err)
+			}
+			for _, dir := range dirs {
+				got, err := os.ReadFile(filepath.Join(dir, path))
+				if tt.want == "" && !os.IsNotExist(err) || tt.want != "" && string(got) != tt.want {
+					t.Errorf("%v = %q, %v, want %q", filepath.Join(dir, path), got, err, tt.want)
+				}
+				conflicts, _ := filepath.Glob(filepath.Join(dir, "a", "f.conflict-*.txt"))
+				if tt.conflicts == "" && len(conflicts) > 0 || tt.conflicts != "" && len(conflicts) != 1 {
+					t.Fatalf("conflict files in %v = %v", dir, conflicts)
+				}
+				for _, conflict := range conflicts {
+					if got, err = os.ReadFile(conflict); string(got) != tt.conflicts {
+						t.Errorf("%v = %q, %v, want %q", conflict, got, err, tt.conflicts)
+					}
+				}
+			}
+			// A pass without changes leaves everything as it is.
+			if err := d.SyncOnce(); err != nil {
+				t.Fatalf("SyncOnce() error = %v", err)
+			}
+			if file, ok := d.storage.GetFile(path); ok != (tt.want != "") || ok && (file.Hash != file.DestHash || file.Status != storage.Sync) {
+				t.Errorf("index entry of %v = %+v, %v", path, file, ok)
+			}
+		})
+	}
+}
+
+func TestDirScanner_DeleteGuard(t *testing.T) {
+	names := []string{"1.txt", "2.txt", filepath.Join("a", "3.txt"), filepath.Join("a", "4.txt")}
+	tests := []struct {
+		name   string
+		opts   Options
+		marker bool
+		// remove removes files from one side, which is "src" unless the
+		// name starts with "dst".
+		remove []string
+		// removeRoot removes the source directory itself.
+		removeRoot bool
+		wantHeld   bool
+		// wantDeleted is the number of files deleted on the other side,
+		// before and after the deletions are acknowledged.
+		wantDeleted, wantAcked int
+	}{
+		{name: "under the limit", opts: Options{MaxDeletes: DeleteLimit{Count: 2}}, remove: names[:2], wantDeleted: 2, wantAcked: 2},
+		{name: "over the limit", opts: Options{MaxDeletes: DeleteLimit{Count: 2}}, remove: names[:3], wantHeld: true, wantAcked: 3},
+		{name: "over the percentage", opts: Options{MaxDeletes: DeleteLimit{Percent: 50}}, remove: names[:3], wantHeld: true, wantAcked: 3},
+		{name: "emptied source", opts: Options{RefuseEmpty: true}, remove: names, wantHeld: true, wantAcked: 4},
+		{name: "missing source", opts: Options{RefuseEmpty: true}, removeRoot: true, wantHeld: true},
+		{name: "marker present", opts: Options{Marker: ".mounted"}, marker: true, remove: names[:1], wantDeleted: 1, wantAcked: 1},
+		{name: "missing marker", opts: Options{Marker: ".mounted"}, remove: append([]string{".mounted"}, names[:1]...), marker: true, wantHeld: true},
+		{name: "two-way over the limit", opts: Options{TwoWay: true, MaxDeletes: DeleteLimit{Count: 1}}, remove: []string{"dst", names[0], names[1]}, wantHeld: true, wantAcked: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dirs := map[string]string{"src": filepath.Join(t.TempDir(), "src"), "dst": t.TempDir()}
+			for _, name := range names {
+				writeFile(t, filepath.Join(dirs["src"], name), name)
+			}
+			if tt.marker {
+				writeFile(t, filepath.Join(dirs["src"], ".mounted"), "")
+			}
+			d := newTestScanner(dirs["src"], dirs["dst"])
+			d.ctx = context.Background()
+			d.opts = tt.opts
+			if err := d.SyncOnce(); err != nil {
+				t.Fatalf("SyncOnce() error = %v", err)
+			}
+			removeFrom, other, remove := "src", "dst", tt.remove
+			if len(remove) > 0 && remove[0] == "dst" {
+				removeFrom, other, remove = "dst", "src", remove[1:]
+			}
+			for _, name := range remove {
+				if err := os.Remove(filepath.Join(dirs[removeFrom], name)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.removeRoot {
+				if err := os.RemoveAll(dirs["src"]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			deleted := func() int {
+				count := 0
+				for _, name := range names {
+					if _, err := os.Stat(filepath.Join(dirs[other], name)); os.IsNotExist(err) {
+						count++
+					}
+				}
+				return count
+			}
+			d.wg.Add(1)
+			d.scan()
+			if held := d.DeletesHeld(); (held != nil) != tt.wantHeld {
+				t.Errorf("DeletesHeld() = %v, want held %v", held, tt.wantHeld)
+			}
+			if got := deleted(); got != tt.wantDeleted {
+				t.Errorf("deleted %v files, want %v", got, tt.wantDeleted)
+			}
+			d.AcknowledgeDeletes()
+			d.wg.Add(1)
+			d.scan()
+			if held := d.DeletesHeld(); (held != nil) != (tt.wantHeld && tt.wantAcked == 0) {
+				t.Errorf("DeletesHeld() after acknowledging = %v", held)
+			}
+			if got := deleted(); got != tt.wantAcked {
+				t.Errorf("deleted %v files after acknowledging, want %v", got, tt.wantAcked)
+			}
+		})
+	}
+}
+
+func TestDirScanner_DeleteGuardApplyRepair(t *testing.T) {
+	names := []string{"1.txt", "2.txt", "3.txt"}
+	tests := []struct {
+		name string
+		// remove deletes the destination files that exist only there.
+		remove func(d *DirScanner) error
+	}{
+		{
+			name: "verify repair",
+			remove: func(d *DirScanner) error {
+				drifts, err := d.Verify(true)
+				for _, drift := range drifts {
+					if drift.Kind == storage.Extra && !drift.Repaired {
+						return ErrDeletesHeld
+					}
+				}
+				return err
+			},
+		},
+		{
+			name: "apply",
+			remove: func(d *DirScanner) error {
+				p := plan.New(d.sourceDir, d.destDir)
+				for _, name := range names {
+					p.Add(plan.Item{Action: plan.Delete, FileName: name})
+				}
+				return d.Apply(p)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srcDir, dstDir := t.TempDir(), t.TempDir()
+			writeFile(t, filepath.Join(srcDir, "0.txt"), "0")
+			for _, name := range names {
+				writeFile(t, filepath.Join(dstDir, name), name)
+			}
+			d := newTestScanner(srcDir, dstDir)
+			d.trigger = make(chan struct{}, 1)
+			d.opts = Options{MaxDeletes: DeleteLimit{Count: 2}}
+			if err := tt.remove(d); !errors.Is(err, ErrDeletesHeld) {
+				t.Errorf("error = %v, want %v", err, ErrDeletesHeld)
+			}
+			for _, name := range names {
+				if _, err := os.Stat(filepath.Join(dstDir, name)); err != nil {
+					t.Errorf("%v was deleted while deletions are held: %v", name, err)
+				}
+			}
+			d.AcknowledgeDeletes()
+			if err := tt.remove(d); err != nil {
+				t.Errorf("error after acknowledging = %v", err)
+			}
+			for _, name := range names {
+				if _, err := os.Stat(filepath.Join(dstDir, name)); !os.IsNotExist(err) {
+					t.Errorf("%v was not deleted after acknowledging", name)
+				}
+			}
+		})
+	}
+}
+
+func TestDirScanner_DeleteAckExpires(t *testing.T) {
+	tests := []struct {
+		name string
+		// flag acknowledges like -acknowledgeDeletes, otherwise the API
+		// acknowledgement is sent while nothing is held.
+		flag bool
+	}{
+		{name: "flag", flag: true},
+		{name: "nothing held"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srcDir, dstDir := t.TempDir(), t.TempDir()
+			for i := 0; i < 10; i++ {
+				writeFile(t, filepath.Join(srcDir, fmt.Sprintf("%v.txt", i)), "file")
+			}
+			d := newTestScanner(srcDir, dstDir)
+			d.trigger = make(chan struct{}, 1)
+			d.WithOptions(Options{MaxDeletes: DeleteLimit{Count: 2}, AcknowledgeDeletes: tt.flag})
+			if !tt.flag {
+				d.AcknowledgeDeletes()
+			}
+			if err := d.SyncOnce(); err != nil {
+				t.Fatalf("SyncOnce() error = %v", err)
+			}
+			for i := 0; i < 10; i++ {
+				if err := os.Remove(filepath.Join(srcDir, fmt.Sprintf("%v.txt", i))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := d.SyncOnce(); !errors.Is(err, ErrDeletesHeld) {
+				t.Errorf("SyncOnce() error = %v, want %v", err, ErrDeletesHeld)
+			}
+			if entries, _ := os.ReadDir(dstDir); len(entries) != 10 {
+				t.Errorf("%v files left in destination, want 10", len(entries))
+			}
+		})
+	}
+}
+
+func TestParseDeleteLimit(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    DeleteLimit
+		wantErr bool
+	}{
+		{value: "", want: DeleteLimit{}},
+		{value: "100", want: DeleteLimit{Count: 100}},
+		{value: "12.5%", want: DeleteLimit{Percent: 12.5}},
+		{value: "-1", wantErr: true},
+		{value: "120%", wantErr: true},
+		{value: "many", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseDeleteLimit(tt.value)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseDeleteLimit(%q) = %v, %v, want %v, error %v", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestNestedDest(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"src", "other", filepath.Join("src", "backup")} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(root, "src"), filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		src     string
+		dst     string
+		want    string
+		wantErr bool
+	}{
+		{name: "disjoint", src: "src", dst: "other"},
+		{name: "sibling with common prefix", src: "src", dst: "src2"},
+		{name: "same directory", src: "src", dst: "src", wantErr: true},
+		{name: "same through a symlink", src: "src", dst: "link", wantErr: true},
+		{name: "source inside destination", src: filepath.Join("src", "backup"), dst: "src", wantErr: true},
+		{name: "nested destination", src: "src", dst: filepath.Join("src", "backup"), want: "backup"},
+		{name: "nested through a symlink", src: "src", dst: filepath.Join("link", "backup"), want: "backup"},
+		{name: "nested destination not created yet", src: "link", dst: filepath.Join("src", "new", "backup"), want: filepath.Join("new", "backup")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NestedDest(filepath.Join(root, tt.src), filepath.Join(root, tt.dst))
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("NestedDest() = %q, %v, want %q, error %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOverlap(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"a", "b", filepath.Join("a", "nested")} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(root, "a"), filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		dir1 string
+		dir2 string
+		want bool
+	}{
+		{name: "disjoint", dir1: "a", dir2: "b"},
+		{name: "sibling with common prefix", dir1: "a", dir2: "a2"},
+		{name: "same directory", dir1: "a", dir2: "a", want: true},
+		{name: "same through a symlink", dir1: "link", dir2: "a", want: true},
+		{name: "first inside second", dir1: filepath.Join("a", "nested"), dir2: "a", want: true},
+		{name: "second inside first", dir1: "link", dir2: filepath.Join("a", "nested"), want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Overlap(filepath.Join(root, tt.dir1), filepath.Join(root, tt.dir2))
+			if err != nil || got != tt.want {
+				t.Errorf("Overlap() = %v, %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDirScanner_Verify(t *testing.T) {
+	tests := []struct {
+		name   string
+		repair bool
+		want   map[string]string
+	}{
+		{name: "report", want: map[string]string{"1.txt": "changed", "extra.txt": "extra"}},
+		{name: "repair", repair: true, want: map[string]string{"1.txt": "1", filepath.Join("a", "2.txt"): "2", "extra.txt": ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srcDir, dstDir := t.TempDir(), t.TempDir()
+			writeFile(t, filepath.Join(srcDir, "1.txt"), "1")
+			writeFile(t, filepath.Join(srcDir, "a", "2.txt"), "2")
+			d := newTestScanner(srcDir, dstDir)
+			d.ctx = context.Background()
+			if err := d.SyncOnce(); err != nil {
+				t.Fatalf("SyncOnce() error = %v", err)
+			}
+			writeFile(t, filepath.Join(dstDir, "1.txt"), "changed")
+			writeFile(t, filepath.Join(dstDir, "extra.txt"), "extra")
+			if err := os.Remove(filepath.Join(dstDir, "a", "2.txt")); err != nil {
+				t.Fatal(err)
+			}
+			drifts, err := d.Verify(tt.repair)
+			if err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+			want := map[string]storage.DriftKind{
+				"1.txt":                     storage.Modified,
+				filepath.Join("a", "2.txt"): storage.Missing,
+				"extra.txt":                 storage.Extra,
+			}
+			if len(drifts) != len(want) {
+				t.Errorf("Verify() = %+v, want %v", drifts, want)
+			}
+			for _, drift := range drifts {
+				if want[drift.FileName] != drift.Kind || drift.Repaired != tt.repair {
+					t.Errorf("Verify() drift = %+v, want %v repaired %v", drift, want[drift.FileName], tt.repair)
+				}
+			}
+			for name, content := range tt.want {
+				got, err := os.ReadFile(filepath.Join(dstDir, name))
+				if content == "" && !os.IsNotExist(err) || content != "" && string(got) != content {
+					t.Errorf("%v = %q, %v, want %q", name, got, err, content)
+				}
+			}
+		})
+	}
+}
+
+func TestDirScanner_SyncOnceBounded(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	for i := 0; i < 300; i++ {
+		writeFile(t, filepath.Join(srcDir, fmt.Sprintf("%v.txt", i)), "file")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d := newTestScanner(srcDir, dstDir)
+	d.ctx = ctx
+	d.filesToSync, d.syncDone = make(chan string, 1), make(chan string, 1)
+	d.opts = Options{CopyWorkers: 2, HashWorkers: 1}
+	before := runtime.NumGoroutine()
+	var maxGoroutines int64
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				if n := int64(runtime.NumGoroutine()); n > atomic.LoadInt64(&maxGoroutines) {
+					atomic.StoreInt64(&maxGoroutines, n)
+				}
+				runtime.Gosched()
+			}
+		}
+	}()
+	err := d.SyncOnce()
+	close(stop)
+	if err != nil {
+		t.Fatalf("SyncOnce() error = %v", err)
+	}
+	entries, err := os.ReadDir(dstDir)
+	if err != nil || len(entries) != 300 {
+		t.Errorf("copied %v files, %v, want 300", len(entries), err)
+	}
+	if got := atomic.LoadInt64(&maxGoroutines) - int64(before); got > 20 {
+		t.Errorf("SyncOnce() started %v goroutines at once", got)
+	}
+}
+
+func TestDirScanner_Backoff(t *testing.T) {
+	d := &DirScanner{opts: Options{RetryDelay: time.Second, RetryMaxDelay: 10 * time.Second}}
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{attempt: 1, max: time.Second},
+		{attempt: 2, max: 2 * time.Second},
+		{attempt: 4, max: 8 * time.Second},
+		{attempt: 5, max: 10 * time.Second},
+		{attempt: 100, max: 10 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.attempt), func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				if got := d.backoff(tt.attempt); got < tt.max/2 || got > tt.max {
+					t.Fatalf("backoff(%v) = %v, want between %v and %v", tt.attempt, got, tt.max/2, tt.max)
+				}
+			}
+		})
+	}
+}
+
+func TestDirScanner_SyncOnceRetry(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(srcDir, "1.txt"), "1")
+	writeFile(t, filepath.Join(srcDir, "2.txt"), "2")
+	// A non-empty directory in place of the copy makes every attempt fail.
+	writeFile(t, filepath.Join(dstDir, "1.txt", "blocker"), "")
+	files := storage.NewFileStorage(map[string]storage.FilesInfo{}, logger)
+	d := newTestScanner(srcDir, dstDir)
+	d.ctx = context.Background()
+	d.storage = generated_storage.NewStorageWithLogrus(files, logger)
+	d.opts = Options{RetryAttempts: 3, RetryDelay: time.Millisecond}
+	if err := d.SyncOnce(); err == nil {
+		t.Fatalf("SyncOnce() error = nil, want failed files")
+	}
+	file, _ := d.storage.GetFile("1.txt")
+	if file.Status != storage.Abandoned || file.Attempts != 3 || file.LastError == "" {
+		t.Errorf("1.txt = %+v, want abandoned after 3 attempts", file)
+	}
+	if file, _ = d.storage.GetFile("2.txt"); file.Status != storage.Sync {
+		t.Errorf("2.txt status = %v, want %v", file.Status, storage.Sync)
+	}
+	if err := d.SyncOnce(); err == nil {
+		t.Errorf("SyncOnce() retried an abandoned file")
+	}
+	if err := os.RemoveAll(filepath.Join(dstDir, "1.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if reset := files.ResetFailed(); reset != 1 {
+		t.Errorf("ResetFailed() = %v, want 1", reset)
+	}
+	if err := d.RetryFailed(); err != nil {
+		t.Fatalf("RetryFailed() error = %v", err)
+	}
+	if file, _ = d.storage.GetFile("1.txt"); file.Status != storage.Sync || file.Attempts != 0 {
+		t.Errorf("1.txt = %+v, want synced", file)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dstDir, "1.txt")); string(got) != "1" {
+		t.Errorf("1.txt = %q, want 1", got)
+	}
+}
+
+func TestDirScanner_PauseResume(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	for i := 0; i < 20; i++ {
+		writeFile(t, filepath.Join(srcDir, fmt.Sprintf("%v.txt", i)), "file")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d := newTestScanner(srcDir, dstDir)
+	d.ctx = ctx
+	d.timeInterval = 3600
+	d.trigger = make(chan struct{}, 1)
+	d.Pause()
+	go d.Run()
+	d.ScanNow()
+	time.Sleep(100 * time.Millisecond)
+	if entries, _ := os.ReadDir(dstDir); len(entries) != 0 {
+		t.Fatalf("copied %v files while paused", len(entries))
+	}
+	d.Resume()
+	if d.Paused() {
+		t.Errorf("Paused() = true after Resume()")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for entries, _ := os.ReadDir(dstDir); len(entries) < 20; entries, _ = os.ReadDir(dstDir) {
+		if time.Now().After(deadline) {
+			t.Fatalf("copied %v files after Resume(), want 20", len(entries))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := d.Drain(); err != nil {
+		t.Errorf("Drain() error = %v", err)
+	}
+	if pending := atomic.LoadInt64(&d.pending); pending != 0 {
+		t.Errorf("%v files pending after Drain()", pending)
+	}
+	cancel()
+	d.Wait()
+}
+
+func TestDirScanner_RunCancel(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	for i := 0; i < 2000; i++ {
+		writeFile(t, filepath.Join(srcDir, fmt.Sprintf("%v.txt", i)), "file")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d := newTestScanner(srcDir, dstDir)
+	d.ctx = ctx
+	d.filesToSync = make(chan string, 5)
+	d.syncDone = make(chan string, 5)
+	d.timeInterval = 1
+	d.trigger = make(chan struct{}, 1)
+	d.opts.CopyWorkers = 2
+	ran := make(chan struct{})
+	go func() {
+		defer close(ran)
+		d.Run()
+	}()
+	d.ScanNow()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	waited := make(chan struct{})
+	go func() {
+		<-ran
+		d.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Wait() blocked after the context was cancelled")
+	}
+}
+
+// flakyHasher fails the first failures hashes.
+type flakyHasher struct {
+	failures *int32
+}
+
+func (h flakyHasher) Name() string {
+	return utils.DefaultHashAlgo
+}
+
+func (h flakyHasher) Sum(path string) (string, error) {
+	if atomic.AddInt32(h.failures, -1) >= 0 {
+		return "", errors.New("device busy")
+	}
+	return utils.DefaultHasher().Sum(path)
+}
+
+func TestDirScanner_RunRetriesHashErrors(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(srcDir, "1.txt"), "1")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d := newTestScanner(srcDir, dstDir)
+	d.ctx = ctx
+	d.timeInterval = 3600
+	d.trigger = make(chan struct{}, 1)
+	d.failures = make(chan struct{}, 1)
+	failures := int32(1)
+	d.opts = Options{Hasher: flakyHasher{failures: &failures}, RetryDelay: 10 * time.Millisecond}
+	go d.Run()
+	d.ScanNow()
+	deadline := time.Now().Add(3 * time.Second)
+	for _, err := os.Stat(filepath.Join(dstDir, "1.txt")); err != nil; _, err = os.Stat(filepath.Join(dstDir, "1.txt")) {
+		if time.Now().After(deadline) {
+			t.Fatalf("file with a hash error was not retried: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	d.Wait()
+}
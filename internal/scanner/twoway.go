@@ -0,0 +1,322 @@
+package scanner
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"sync_dir/internal/ignore"
+	"sync_dir/internal/storage"
+	"sync_dir/internal/utils"
+	"time"
+)
+
+// ConflictPolicy tells a two-way sync which copy wins when a file changed on
+// both sides since the last sync.
+type ConflictPolicy string
+
+const (
+	// ConflictNewest keeps the copy modified last.
+	ConflictNewest ConflictPolicy = "newest"
+	// ConflictSource keeps the source copy.
+	ConflictSource ConflictPolicy = "source"
+	// ConflictKeepBoth keeps the source copy under the file name and the
+	// destination copy next to it with a .conflict-<host>-<time> suffix.
+	ConflictKeepBoth ConflictPolicy = "keep-both"
+)
+
+func ParseConflictPolicy(value string) (ConflictPolicy, error) {
+	switch policy := ConflictPolicy(value); policy {
+	case ConflictNewest, ConflictSource, ConflictKeepBoth:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown conflict policy %q, supported: newest, source, keep-both", value)
+}
+
+// side is the state of a file on one side of a two-way sync.
+type side struct {
+	dir  string
+	path string
+	info fs.FileInfo
+	// hash is computed only when the file looks changed.
+	hash string
+	// changed means the file differs from the last synced copy, removed
+	// files are changed if they were synced.
+	changed bool
+}
+
+func (s *side) exists() bool {
+	return s.info != nil
+}
+
+// syncTwoWay runs one pass of a two-way sync: changes made on either side
+// since the last pass are copied or deleted on the other one. Only regular
+// files are synced.
+func (d *DirScanner) syncTwoWay() error {
+	atomic.AddInt32(&d.walks, 1)
+	defer d.progressed()
+	defer atomic.AddInt32(&d.walks, -1)
+	srcFiles, err := d.listFiles(d.sourceDir)
+	if err != nil {
+		return err
+	}
+	dstFiles, err := d.listFiles(d.destDir)
+	if err != nil {
+		return err
+	}
+	names := map[string]bool{}
+	for fileName := range srcFiles {
+		names[fileName] = true
+	}
+	for fileName := range dstFiles {
+		names[fileName] = true
+	}
+	for _, file := range d.storage.FindRemoved() {
+		names[file.FileName] = true
+	}
+	missingInSource, missingInDest := 0, 0
+	for fileName := range names {
+		if _, synced := d.storage.GetFile(fileName); !synced {
+			continue
+		}
+		switch {
+		case srcFiles[fileName] == nil && dstFiles[fileName] != nil:
+			missingInSource++
+		case dstFiles[fileName] == nil && srcFiles[fileName] != nil:
+			missingInDest++
+		}
+	}
+	holdDeletes := !d.allowDeletes(d.storage.Len(),
+		deletes{dir: d.sourceDir, count: missingInSource},
+		deletes{dir: d.destDir, count: missingInDest})
+	failed := 0
+	for fileName := range names {
+		if err = d.ctx.Err(); err != nil {
+			return err
+		}
+		src := &side{dir: d.sourceDir, path: filepath.Join(d.sourceDir, fileName), info: srcFiles[fileName]}
+		dst := &side{dir: d.destDir, path: filepath.Join(d.destDir, fileName), info: dstFiles[fileName]}
+		if err = d.syncBothWays(fileName, src, dst, holdDeletes); err != nil {
+			d.logger.Errorf("Can't sync %v both ways: %v", fileName, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%v files failed to sync", failed)
+	}
+	if holdDeletes {
+		return fmt.Errorf("%w: %v", ErrDeletesHeld, d.DeletesHeld())
+	}
+	return nil
+}
+
+// listFiles returns the regular files under root by their names relative to
+// root, leaving out ignored and temporary files and the tool's directories.
+// The top directories named like the tool's are left out on both sides, so
+// they never look deleted on one of them.
+func (d *DirScanner) listFiles(root string) (map[string]fs.FileInfo, error) {
+	state := newWalkState(d.opts.Ignore)
+	files := map[string]fs.FileInfo{}
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			d.logger.Warnf("Skip path %v: %v", path, err)
+			return nil
+		}
+		fileName, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if fileName == "." {
+			return nil
+		}
+		if entry.IsDir() {
+			if internalDir(root, path) || state.ignore.Match(filepath.ToSlash(fileName), true) {
+				return fs.SkipDir
+			}
+			if err = state.ignore.AddFile(filepath.ToSlash(fileName), filepath.Join(path, ignore.FileName)); err != nil {
+				d.logger.Warnf("Can't read ignore rules in %v: %v", fileName, err)
+			}
+			return nil
+		}
+		if utils.IsTempFile(entry.Name()) || state.ignore.Match(filepath.ToSlash(fileName), false) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			d.logger.Warnf("Skip path %v: %v", path, err)
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			files[fileName] = info
+		}
+		return nil
+	})
+	return files, err
+}
+
+// syncBothWays copies or deletes a file changed on one side. Deletions are
+// skipped if holdDeletes is set.
+func (d *DirScanner) syncBothWays(fileName string, src, dst *side, holdDeletes bool) error {
+	file, synced := d.storage.GetFile(fileName)
+	if err := d.detectChange(src, synced, file.Hash, file.LastModified); err != nil {
+		return err
+	}
+	destHash := file.DestHash
+	if destHash == "" {
+		destHash = file.Hash
+	}
+	if err := d.detectChange(dst, synced, destHash, file.DestModified); err != nil {
+		return err
+	}
+	switch {
+	case !src.changed && !dst.changed:
+		return nil
+	case !src.exists() && !dst.exists():
+		d.storage.Forget(fileName)
+		return nil
+	case src.changed && dst.changed && src.exists() && dst.exists():
+		if src.hash == dst.hash {
+			return d.recordBoth(fileName, src, dst)
+		}
+		return d.resolveConflict(fileName, src, dst)
+	case src.changed && dst.changed:
+		// A change wins over a deletion on the other side, so no edit is lost.
+		if src.exists() {
+			return d.copyOver(fileName, src, dst)
+		}
+		return d.copyOver(fileName, dst, src)
+	case holdDeletes && (src.changed && !src.exists() || dst.changed && !dst.exists()):
+		return nil
+	case src.changed:
+		return d.copyOver(fileName, src, dst)
+	}
+	return d.copyOver(fileName, dst, src)
+}
+
+// detectChange compares a side with the last synced copy, whose hash and
+// modification time are given. Files are hashed only if their modification
+// time differs.
+func (d *DirScanner) detectChange(s *side, synced bool, hash string, modified time.Time) error {
+	if !s.exists() {
+		s.changed = synced
+		return nil
+	}
+	if synced && !modified.IsZero() && s.info.ModTime().Equal(modified) {
+		s.hash = hash
+		return nil
+	}
+	release := d.hashSlot()
+	sum, err := d.hasher().Sum(s.path)
+	release()
+	if err != nil {
+		return err
+	}
+	s.hash = sum
+	s.changed = !synced || sum != hash
+	return nil
+}
+
+func (d *DirScanner) resolveConflict(fileName string, src, dst *side) error {
+	d.logger.Warnf("File %v changed in both directories", fileName)
+	switch d.opts.Conflicts {
+	case ConflictSource:
+		return d.copyOver(fileName, src, dst)
+	case ConflictKeepBoth:
+		conflictName := d.conflictName(fileName, dst.info.ModTime())
+		conflict := &side{dir: d.destDir, path: filepath.Join(d.destDir, conflictName), hash: dst.hash}
+		if err := os.Rename(dst.path, conflict.path); err != nil {
+			return err
+		}
+		d.logger.Infof("Keep destination copy of %v as %v", fileName, conflictName)
+		dst.info = nil
+		if err := d.copyOver(fileName, src, dst); err != nil {
+			return err
+		}
+		var err error
+		if conflict.info, err = os.Stat(conflict.path); err != nil {
+			return err
+		}
+		return d.copyOver(conflictName, conflict, &side{dir: d.sourceDir, path: filepath.Join(d.sourceDir, conflictName)})
+	}
+	if dst.info.ModTime().After(src.info.ModTime()) {
+		return d.copyOver(fileName, dst, src)
+	}
+	return d.copyOver(fileName, src, dst)
+}
+
+// conflictName inserts .conflict-<host>-<time> before the extension of
+// fileName.
+func (d *DirScanner) conflictName(fileName string, modified time.Time) string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	ext := filepath.Ext(fileName)
+	stem := strings.TrimSuffix(fileName, ext)
+	return fmt.Sprintf("%v.conflict-%v-%v%v", stem, host, modified.UTC().Format("20060102-150405"), ext)
+}
+
+// copyOver makes to a copy of from, or deletes to if from was deleted, and
+// records both sides as synced.
+func (d *DirScanner) copyOver(fileName string, from, to *side) error {
+	if !from.exists() {
+		if err := d.removeSide(fileName, to); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		d.logger.Infof("Delete file %v from %v", fileName, to.dir)
+		d.storage.Forget(fileName)
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(to.path), 0755); err != nil {
+		return err
+	}
+	if to.dir == d.destDir && d.opts.Versions != nil {
+		if err := d.opts.Versions.Save(fileName); err != nil {
+			return err
+		}
+	}
+	d.logger.Printf("Copy file %v to %v with size %v bytes\n", fileName, to.dir, from.info.Size())
+	stats, err := d.copier()(from.path, to.path, d.opts.Preserve)
+	if err != nil {
+		return err
+	}
+	d.wrote(fileName, stats)
+	info, err := os.Stat(to.path)
+	if err != nil {
+		return err
+	}
+	to.info, to.hash = info, from.hash
+	if from.dir == d.sourceDir {
+		return d.recordBoth(fileName, from, to)
+	}
+	return d.recordBoth(fileName, to, from)
+}
+
+func (d *DirScanner) removeSide(fileName string, s *side) error {
+	if s.dir == d.destDir {
+		return d.removeDest(fileName)
+	}
+	return os.Remove(s.path)
+}
+
+// recordBoth saves both sides of a file with the same content as synced.
+func (d *DirScanner) recordBoth(fileName string, src, dst *side) error {
+	file, _ := d.storage.GetFile(fileName)
+	file.FileName = fileName
+	file.FilePath = src.path
+	file.Hash = src.hash
+	file.HashAlgo = d.hasher().Name()
+	file.LastModified = src.info.ModTime()
+	file.DestHash = dst.hash
+	file.DestModified = dst.info.ModTime()
+	file.Metadata = d.metadata(src.path, src.info)
+	file.Status = storage.Sync
+	file.LastError, file.Attempts, file.NextRetry = "", 0, time.Time{}
+	d.storage.PutFile(file)
+	return nil
+}
@@ -0,0 +1,121 @@
+package scanner
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync_dir/internal/storage"
+	"sync_dir/internal/utils"
+)
+
+// Verify re-hashes destination files against the index and looks for files
+// that exist only in the destination. With repair set, modified and missing
+// files are copied from the source again and unexpected files are removed
+// before it returns.
+func (d *DirScanner) Verify(repair bool) ([]storage.Drift, error) {
+	var drifts []storage.Drift
+	err := d.pass(func() error {
+		var err error
+		drifts, err = d.verify(repair)
+		return err
+	})
+	return drifts, err
+}
+
+// scrub runs a scheduled verification of the destination and logs what it finds.
+func (d *DirScanner) scrub() {
+	defer d.wg.Done()
+	drifts, err := d.verify(d.opts.Repair)
+	if err != nil {
+		d.logger.Errorf("Can't verify %v: %v", d.destDir, err)
+		return
+	}
+	for _, drift := range drifts {
+		if drift.Repaired {
+			d.logger.Warnf("Destination file %v is %v, repaired", drift.FileName, drift.Kind)
+		} else {
+			d.logger.Warnf("Destination file %v is %v %v", drift.FileName, drift.Kind, drift.Err)
+		}
+	}
+	d.logger.Infof("Verify of %v finished, %v files differ from the index", d.destDir, len(drifts))
+}
+
+// verify finds the drifts and repairs them if repair is set. Unexpected
+// files are removed only if the deletion guard allows it.
+func (d *DirScanner) verify(repair bool) ([]storage.Drift, error) {
+	defer d.beginPass()()
+	drifts := d.storage.Verify(d.destDir)
+	extra, err := d.findExtra()
+	if err != nil {
+		return nil, err
+	}
+	drifts = append(drifts, extra...)
+	if !repair {
+		return drifts, nil
+	}
+	removeExtra := d.allowDeletes(d.storage.Len()+len(extra), deletes{dir: d.sourceDir, count: len(extra)})
+	for i := range drifts {
+		if drifts[i].Kind == storage.Extra && !removeExtra {
+			drifts[i].Err = ErrDeletesHeld.Error()
+			continue
+		}
+		drifts[i].Repaired = d.repair(drifts[i])
+	}
+	return drifts, nil
+}
+
+// findExtra lists destination files that are neither in the index nor in the
+// source directory.
+func (d *DirScanner) findExtra() ([]storage.Drift, error) {
+	var drifts []storage.Drift
+	err := filepath.WalkDir(d.destDir, func(path string, dir fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if dir.IsDir() {
+			if internalDir(d.destDir, path) {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if utils.IsTempFile(dir.Name()) {
+			return nil
+		}
+		fileName, err := filepath.Rel(d.destDir, path)
+		if err != nil {
+			return err
+		}
+		if _, ok := d.storage.GetFile(fileName); ok {
+			return nil
+		}
+		if _, err = os.Lstat(filepath.Join(d.sourceDir, fileName)); os.IsNotExist(err) {
+			drifts = append(drifts, storage.Drift{FileName: fileName, Kind: storage.Extra})
+		}
+		return nil
+	})
+	return drifts, err
+}
+
+func (d *DirScanner) repair(drift storage.Drift) bool {
+	switch drift.Kind {
+	case storage.Extra:
+		if err := d.removeDest(drift.FileName); err != nil {
+			d.logger.Warnf("Can't remove unexpected file %v: %v", drift.FileName, err)
+			return false
+		}
+		d.logger.Infof("Delete file %v existing only in destination directory", drift.FileName)
+		return true
+	case storage.Missing, storage.Modified:
+		file, ok := d.storage.GetFile(drift.FileName)
+		if !ok {
+			return false
+		}
+		if _, err := os.Lstat(file.FilePath); err != nil {
+			return false
+		}
+		d.logger.Infof("Restore file %v from source directory", drift.FileName)
+		d.queue(file)
+		return true
+	}
+	return false
+}
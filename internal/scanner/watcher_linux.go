@@ -0,0 +1,130 @@
+//go:build linux
+
+package scanner
+
+import (
+	"errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"unsafe"
+)
+
+const watchMask = unix.IN_CREATE | unix.IN_CLOSE_WRITE | unix.IN_MODIFY | unix.IN_ATTRIB |
+	unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_DELETE_SELF | unix.IN_ONLYDIR
+
+// Watcher reports changed paths under a directory tree using inotify.
+// Newly created directories are watched as soon as they show up.
+type Watcher struct {
+	sync.Mutex
+	file     *os.File
+	logger   *logrus.Entry
+	dirs     map[int]string
+	Events   chan string
+	Overflow chan struct{}
+}
+
+func NewWatcher(root string, logger *logrus.Entry) (*Watcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	w := &Watcher{
+		file:     os.NewFile(uintptr(fd), "inotify"),
+		logger:   logger,
+		dirs:     map[int]string{},
+		Events:   make(chan string, 100),
+		Overflow: make(chan struct{}, 1),
+	}
+	if err = w.addTree(root); err != nil {
+		w.file.Close()
+		return nil, err
+	}
+	go w.read()
+	return w, nil
+}
+
+func (w *Watcher) Close() error {
+	return w.file.Close()
+}
+
+func (w *Watcher) addTree(root string) error {
+	return filepath.WalkDir(root, func(path string, dir fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			return nil
+		}
+		if !dir.IsDir() {
+			return nil
+		}
+		wd, err := unix.InotifyAddWatch(int(w.file.Fd()), path, watchMask)
+		if err != nil {
+			w.logger.Warnf("Can't watch directory %v: %v", path, err)
+			return nil
+		}
+		w.Lock()
+		w.dirs[wd] = path
+		w.Unlock()
+		return nil
+	})
+}
+
+func (w *Watcher) read() {
+	defer close(w.Events)
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				w.logger.Errorf("Error reading inotify events: %v", err)
+			}
+			return
+		}
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+unix.SizeofInotifyEvent : offset+unix.SizeofInotifyEvent+int(event.Len)]
+			offset += unix.SizeofInotifyEvent + int(event.Len)
+			w.handle(event, string(trimNull(nameBytes)))
+		}
+	}
+}
+
+func (w *Watcher) handle(event *unix.InotifyEvent, name string) {
+	if event.Mask&unix.IN_Q_OVERFLOW != 0 {
+		select {
+		case w.Overflow <- struct{}{}:
+		default:
+		}
+		return
+	}
+	w.Lock()
+	dir, ok := w.dirs[int(event.Wd)]
+	if event.Mask&unix.IN_IGNORED != 0 {
+		delete(w.dirs, int(event.Wd))
+	}
+	w.Unlock()
+	if !ok || event.Mask&unix.IN_IGNORED != 0 {
+		return
+	}
+	path := filepath.Join(dir, name)
+	if event.Mask&unix.IN_ISDIR != 0 && event.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 {
+		if err := w.addTree(path); err != nil {
+			w.logger.Warnf("Can't watch directory %v: %v", path, err)
+		}
+	}
+	w.Events <- path
+}
+
+func trimNull(name []byte) []byte {
+	for i, b := range name {
+		if b == 0 {
+			return name[:i]
+		}
+	}
+	return name
+}
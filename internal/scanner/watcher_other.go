@@ -0,0 +1,21 @@
+//go:build !linux
+
+package scanner
+
+import (
+	"errors"
+	"github.com/sirupsen/logrus"
+)
+
+type Watcher struct {
+	Events   chan string
+	Overflow chan struct{}
+}
+
+func NewWatcher(root string, logger *logrus.Entry) (*Watcher, error) {
+	return nil, errors.New("watch mode is supported only on linux")
+}
+
+func (w *Watcher) Close() error {
+	return nil
+}
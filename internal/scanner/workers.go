@@ -0,0 +1,113 @@
+package scanner
+
+import (
+	"os"
+	"runtime"
+	"sync/atomic"
+)
+
+type copyResult struct {
+	fileName string
+	err      error
+}
+
+func (d *DirScanner) copyWorkers() int {
+	if d.opts.CopyWorkers > 0 {
+		return d.opts.CopyWorkers
+	}
+	return runtime.NumCPU()
+}
+
+func (d *DirScanner) hashWorkers() int {
+	if d.opts.HashWorkers > 0 {
+		return d.opts.HashWorkers
+	}
+	return runtime.NumCPU()
+}
+
+// startWorkers starts the copy workers once. They take queued files from
+// filesToSync, so the scanner blocks in queue while all of them are busy.
+func (d *DirScanner) startWorkers() {
+	d.workersOnce.Do(func() {
+		d.copied = make(chan copyResult)
+		d.hashSlots = make(chan struct{}, d.hashWorkers())
+		for i := 0; i < d.copyWorkers(); i++ {
+			go d.worker()
+		}
+	})
+}
+
+func (d *DirScanner) worker() {
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case fileName := <-d.filesToSync:
+			if !d.waitResumed() {
+				return
+			}
+			d.wg.Add(1)
+			err := d.self().CopyFile(fileName)
+			select {
+			case d.copied <- copyResult{fileName: fileName, err: err}:
+			case <-d.ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// copyFinished accounts for a file a worker is done with and reports
+// whether it was copied. Failed files are scheduled for a retry.
+func (d *DirScanner) copyFinished(result copyResult) bool {
+	atomic.AddInt64(&d.pending, -1)
+	defer d.progressed()
+	if result.err == nil {
+		return true
+	}
+	file, ok := d.storage.GetFile(result.fileName)
+	if _, err := os.Lstat(file.FilePath); !ok || os.IsNotExist(err) {
+		d.logger.Infof("File %v disappeared before it was copied", result.fileName)
+		return false
+	}
+	d.logger.Errorf("Can't copy file %v: %v", result.fileName, result.err)
+	d.fail(file, result.err)
+	return false
+}
+
+// hashSlot waits until fewer than HashWorkers files are being hashed and
+// returns the function releasing the slot. Hashing is not limited before
+// the workers are started, as in a dry run, where a single walk hashes one
+// file at a time.
+func (d *DirScanner) hashSlot() func() {
+	if d.hashSlots == nil {
+		return func() {}
+	}
+	d.hashSlots <- struct{}{}
+	return func() { <-d.hashSlots }
+}
+
+// syncPaths syncs the paths of one batch of watch events one after another.
+// Existing paths go first, so a file moved within the batch is renamed in
+// the destination before its old name is deleted.
+func (d *DirScanner) syncPaths(paths []string) {
+	defer d.wg.Done()
+	var removed []string
+	for _, path := range paths {
+		if _, err := os.Lstat(path); os.IsNotExist(err) {
+			removed = append(removed, path)
+			continue
+		}
+		d.syncPath(path)
+	}
+	for _, path := range removed {
+		d.syncPath(path)
+	}
+}
+
+func (d *DirScanner) syncPath(path string) {
+	d.wg.Add(1)
+	if err := d.SyncPath(path); err != nil {
+		d.logger.Warnf("Can't sync %v: %v", path, err)
+	}
+}
@@ -1,18 +1,26 @@
 package storage
 
 import (
+	"context"
 	"github.com/sirupsen/logrus"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"sync_dir/internal/utils"
+	"sync_dir/internal/versions"
 	"time"
 )
 
 type Files struct {
 	sync.RWMutex
-	m      map[string]FilesInfo
-	logger *logrus.Entry
+	m        map[string]FilesInfo
+	logger   *logrus.Entry
+	journal  *Journal
+	hasher   utils.Hasher
+	versions *versions.Store
+	deleted  int64
 }
 
 func (f *Files) GetFile(fileName string) (FilesInfo, bool) {
@@ -22,38 +30,143 @@ func (f *Files) GetFile(fileName string) (FilesInfo, bool) {
 	return file, ok
 }
 
+func (f *Files) PutFile(file FilesInfo) {
+	f.Lock()
+	defer f.Unlock()
+	f.m[file.FileName] = file
+	f.persist(file)
+}
+
+// Rename replaces the entry of a file moved in the source directory with the
+// entry of its new name, whose destination copy is already in place.
+func (f *Files) Rename(oldName string, file FilesInfo) {
+	f.Lock()
+	defer f.Unlock()
+	delete(f.m, oldName)
+	f.forget(oldName)
+	file.Status = Sync
+	file.LastError, file.Attempts, file.NextRetry = "", 0, time.Time{}
+	f.m[file.FileName] = file
+	f.persist(file)
+}
+
+// Forget removes a file from the index without touching the destination.
+func (f *Files) Forget(fileName string) {
+	f.Lock()
+	defer f.Unlock()
+	if _, ok := f.m[fileName]; ok {
+		delete(f.m, fileName)
+		f.forget(fileName)
+	}
+}
+
 func (f *Files) ChangeStatusToSync(fileName string, wg *sync.WaitGroup) {
 	defer wg.Done()
 	f.Lock()
 	defer f.Unlock()
 	file := f.m[fileName]
 	file.Status = Sync
+	file.LastError, file.Attempts, file.NextRetry = "", 0, time.Time{}
 	f.m[fileName] = file
+	f.persist(file)
 }
 
-func (f *Files) IsFileChanged(path string, lastModified time.Time) (bool, string) {
-	_, fileName := filepath.Split(path)
+// MarkFailed records a failed attempt to sync the file. A zero nextRetry
+// means the file is not retried automatically any more.
+func (f *Files) MarkFailed(file FilesInfo, err error, nextRetry time.Time) {
 	f.Lock()
 	defer f.Unlock()
-	file := f.m[fileName]
+	file.Status = Failed
+	if nextRetry.IsZero() {
+		file.Status = Abandoned
+	}
+	file.LastError = err.Error()
+	file.NextRetry = nextRetry
+	f.m[file.FileName] = file
+	f.persist(file)
+	if file.Status == Abandoned {
+		f.logger.Errorf("File %v failed %v times, giving up: %v", file.FileName, file.Attempts, err)
+	} else {
+		f.logger.Warnf("File %v failed, will retry at %v: %v", file.FileName, nextRetry.Format(time.RFC3339), err)
+	}
+}
+
+// Failed returns files waiting for a retry and abandoned files sorted by name.
+func (f *Files) Failed() []FilesInfo {
+	var failed []FilesInfo
+	for _, file := range f.List() {
+		if file.Status == Failed || file.Status == Abandoned {
+			failed = append(failed, file)
+		}
+	}
+	return failed
+}
+
+// ResetFailed makes failed and abandoned files due for a retry with a fresh
+// attempt counter. All of them are reset if no names are given. Returns the
+// number of files reset.
+func (f *Files) ResetFailed(fileNames ...string) int {
+	f.Lock()
+	defer f.Unlock()
+	reset := 0
+	for name, file := range f.m {
+		if file.Status != Failed && file.Status != Abandoned {
+			continue
+		}
+		if len(fileNames) > 0 && !contains(fileNames, name) {
+			continue
+		}
+		file.Status = Failed
+		file.Attempts, file.NextRetry = 0, time.Time{}
+		f.m[name] = file
+		f.persist(file)
+		reset++
+	}
+	return reset
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Files) IsFileChanged(fileName, path string, lastModified time.Time) (bool, string, error) {
+	file, _ := f.GetFile(fileName)
 	if file.LastModified.Before(lastModified) {
-		hash := utils.FileMD5(path)
+		hash, err := f.hash(path)
+		if err != nil {
+			return false, file.Hash, err
+		}
 		if file.Hash == hash {
-			return false, file.Hash
+			return false, file.Hash, nil
 		} else {
-			return true, hash
+			return true, hash, nil
 		}
 	}
-	return false, file.Hash
+	return false, file.Hash, nil
 }
 
-func (f *Files) AddFileToSync(file FilesInfo, wg *sync.WaitGroup, filesToSync chan string) {
+// AddFileToSync marks the file as queued and sends it to filesToSync. The
+// lock is released before sending, so copiers can read the storage while
+// the sender waits for a free one. It gives up when ctx is done, the file
+// stays queued and is checked again when the index is loaded again.
+func (f *Files) AddFileToSync(ctx context.Context, file FilesInfo, wg *sync.WaitGroup, filesToSync chan string) error {
 	defer wg.Done()
 	f.Lock()
-	defer f.Unlock()
 	file.Status = InSync
 	f.m[file.FileName] = file
-	filesToSync <- file.FileName
+	f.persist(file)
+	f.Unlock()
+	select {
+	case filesToSync <- file.FileName:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (f *Files) CheckIfExistAndRemove(dstDir string, wg *sync.WaitGroup) error {
@@ -61,11 +174,14 @@ func (f *Files) CheckIfExistAndRemove(dstDir string, wg *sync.WaitGroup) error {
 	defer f.Unlock()
 	defer wg.Done()
 	for _, file := range f.m {
-		if _, err := os.Stat(file.FilePath); os.IsNotExist(err) {
-			err = os.Remove(filepath.Join(dstDir, file.FileName))
-			if err == nil {
+		if _, err := os.Lstat(file.FilePath); os.IsNotExist(err) {
+			err = f.remove(dstDir, file.FileName)
+			if err == nil || os.IsNotExist(err) {
 				delete(f.m, file.FileName)
+				f.forget(file.FileName)
+				atomic.AddInt64(&f.deleted, 1)
 				f.logger.Infof("Delete file %v from destination directory", file.FileName)
+				removeEmptyParents(dstDir, file)
 			} else {
 				return err
 			}
@@ -74,9 +190,236 @@ func (f *Files) CheckIfExistAndRemove(dstDir string, wg *sync.WaitGroup) error {
 	return nil
 }
 
+// FindRemoved returns files that no longer exist in the source directory
+// without removing anything.
+func (f *Files) FindRemoved() []FilesInfo {
+	f.RLock()
+	defer f.RUnlock()
+	var removed []FilesInfo
+	for _, file := range f.m {
+		if _, err := os.Lstat(file.FilePath); os.IsNotExist(err) {
+			removed = append(removed, file)
+		}
+	}
+	return removed
+}
+
+// List returns all files in the index sorted by name.
+func (f *Files) List() []FilesInfo {
+	f.RLock()
+	defer f.RUnlock()
+	files := make([]FilesInfo, 0, len(f.m))
+	for _, file := range f.m {
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].FileName < files[j].FileName
+	})
+	return files
+}
+
+// WithVersions makes deleted destination files move to store instead of
+// being removed.
+func (f *Files) WithVersions(store *versions.Store) *Files {
+	f.versions = store
+	return f
+}
+
+func (f *Files) remove(dstDir, fileName string) error {
+	if f.versions != nil {
+		return f.versions.Remove(fileName)
+	}
+	return os.Remove(filepath.Join(dstDir, fileName))
+}
+
+// Deleted returns the number of files CheckIfExistAndRemove deleted from
+// the destination.
+func (f *Files) Deleted() int64 {
+	return atomic.LoadInt64(&f.deleted)
+}
+
+// Len returns the number of files in the index.
+func (f *Files) Len() int {
+	f.RLock()
+	defer f.RUnlock()
+	return len(f.m)
+}
+
+// removeEmptyParents removes the destination directories of a deleted file
+// while they are empty and missing from the source directory.
+func removeEmptyParents(dstDir string, file FilesInfo) {
+	srcDir := filepath.Dir(file.FilePath)
+	for dir := filepath.Dir(file.FileName); dir != "." && dir != string(filepath.Separator); dir = filepath.Dir(dir) {
+		if _, err := os.Stat(srcDir); !os.IsNotExist(err) {
+			return
+		}
+		if os.Remove(filepath.Join(dstDir, dir)) != nil {
+			return
+		}
+		srcDir = filepath.Dir(srcDir)
+	}
+}
+
+func (f *Files) WithHasher(hasher utils.Hasher) *Files {
+	f.hasher = hasher
+	return f
+}
+
+func (f *Files) hash(path string) (string, error) {
+	if f.hasher == nil {
+		return utils.DefaultHasher().Sum(path)
+	}
+	return f.hasher.Sum(path)
+}
+
+func (f *Files) hashAlgo() string {
+	if f.hasher == nil {
+		return utils.DefaultHashAlgo
+	}
+	return f.hasher.Name()
+}
+
+// MigrateHashes re-hashes the source files recorded with another algorithm,
+// and the destination copies of two-way entries. Files whose destination
+// copy is missing are dropped from the index so the next scan copies them
+// again. Entries with a side changed since the last sync keep the old hashes,
+// which no longer match, so the next scan syncs the change and records new
+// ones. Returns the number of migrated files.
+func (f *Files) MigrateHashes(srcDir, dstDir string) int {
+	f.Lock()
+	defer f.Unlock()
+	algo := f.hashAlgo()
+	migrated := 0
+	for name, file := range f.m {
+		fileAlgo := file.HashAlgo
+		if fileAlgo == "" {
+			fileAlgo = utils.DefaultHashAlgo
+		}
+		if fileAlgo == algo || file.LinkTarget != "" {
+			continue
+		}
+		dst := filepath.Join(dstDir, name)
+		dstInfo, err := os.Stat(dst)
+		if err != nil || !dstInfo.Mode().IsRegular() {
+			delete(f.m, name)
+			f.forget(name)
+			continue
+		}
+		src := filepath.Join(srcDir, name)
+		srcInfo, err := os.Stat(src)
+		if err != nil || !srcInfo.ModTime().Equal(file.LastModified) ||
+			file.DestHash != "" && !dstInfo.ModTime().Equal(file.DestModified) {
+			continue
+		}
+		if file.Hash, err = f.hash(src); err == nil && file.DestHash != "" {
+			file.DestHash, err = f.hash(dst)
+		}
+		if err != nil {
+			f.logger.Warnf("Can't migrate hash of %v: %v", name, err)
+			continue
+		}
+		file.HashAlgo = algo
+		f.m[name] = file
+		f.persist(file)
+		migrated++
+	}
+	if migrated > 0 {
+		f.logger.Infof("Migrated %v files in index from other hash algorithms to %v", migrated, algo)
+	}
+	return migrated
+}
+
+func (f *Files) persist(file FilesInfo) {
+	if f.journal == nil {
+		return
+	}
+	if err := f.journal.Put(file); err != nil {
+		f.logger.Errorf("Can't write %v to journal: %v", file.FileName, err)
+	}
+	f.compact()
+}
+
+func (f *Files) forget(fileName string) {
+	if f.journal == nil {
+		return
+	}
+	if err := f.journal.Delete(fileName); err != nil {
+		f.logger.Errorf("Can't write %v to journal: %v", fileName, err)
+	}
+	f.compact()
+}
+
+func (f *Files) compact() {
+	if !f.journal.needSnapshot() {
+		return
+	}
+	if err := f.journal.Snapshot(f.m); err != nil {
+		f.logger.Errorf("Can't write index snapshot: %v", err)
+	}
+}
+
+func (f *Files) Close() error {
+	f.Lock()
+	defer f.Unlock()
+	if f.journal == nil {
+		return nil
+	}
+	if err := f.journal.Snapshot(f.m); err != nil {
+		f.journal.Close()
+		return err
+	}
+	return f.journal.Close()
+}
+
 func NewFileStorage(m map[string]FilesInfo, logger *logrus.Entry) *Files {
 	return &Files{
 		m:      m,
 		logger: logger,
 	}
 }
+
+// LoadFileStorage loads the index kept in indexDir into memory. Changes are
+// not written back, which suits dry runs. Queued files are marked for a
+// check like NewPersistentStorage does.
+func LoadFileStorage(indexDir string, logger *logrus.Entry) (*Files, error) {
+	m, _, err := loadIndex(indexDir)
+	if err != nil {
+		return nil, err
+	}
+	return NewFileStorage(recheckQueued(m), logger), nil
+}
+
+// ReadFileStorage loads the index kept in indexDir as it is, with the files
+// still queued by a running sync, for reports.
+func ReadFileStorage(indexDir string, logger *logrus.Entry) (*Files, error) {
+	m, _, err := loadIndex(indexDir)
+	if err != nil {
+		return nil, err
+	}
+	return NewFileStorage(m, logger), nil
+}
+
+// NewPersistentStorage loads the index kept in indexDir and journals every
+// further change there. Files that were still queued for copying when the
+// previous run stopped are marked failed and due, so the next scan checks
+// them again.
+func NewPersistentStorage(indexDir string, logger *logrus.Entry) (*Files, error) {
+	if err := os.MkdirAll(indexDir, 0755); err != nil {
+		return nil, err
+	}
+	m, applied, err := loadIndex(indexDir)
+	if err != nil {
+		return nil, err
+	}
+	m = recheckQueued(m)
+	journal, err := openJournal(indexDir, m)
+	if err != nil {
+		return nil, err
+	}
+	logger.Infof("Loaded %v files from index %v (%v journal records replayed)", len(m), indexDir, applied)
+	return &Files{
+		m:       m,
+		logger:  logger,
+		journal: journal,
+	}, nil
+}
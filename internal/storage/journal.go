@@ -0,0 +1,223 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"sync_dir/internal/utils"
+	"time"
+)
+
+const (
+	IndexDirName     = ".sync_dir"
+	snapshotFileName = "index.snapshot"
+	journalFileName  = "index.journal"
+	snapshotEvery    = 1000
+	// syncInterval is how often written journal records are fsynced
+	// together. A crash loses at most the changes of the last interval,
+	// which makes the next run check those files again.
+	syncInterval = 100 * time.Millisecond
+)
+
+type journalOp string
+
+const (
+	opPut    journalOp = "put"
+	opDelete journalOp = "delete"
+)
+
+type journalRecord struct {
+	Op   journalOp `json:"op"`
+	File FilesInfo `json:"file"`
+}
+
+// Journal keeps the index on disk as a snapshot plus an append-only log of
+// changes made since that snapshot was written.
+type Journal struct {
+	dir     string
+	file    *os.File
+	entries int
+	// unsynced is 1 while records written since the last fsync are pending.
+	unsynced int32
+	// syncErr keeps the error of a background fsync for the next append.
+	syncErr error
+	errMu   sync.Mutex
+	done    chan struct{}
+	synced  sync.WaitGroup
+}
+
+func (j *Journal) Put(file FilesInfo) error {
+	return j.append(journalRecord{Op: opPut, File: file})
+}
+
+func (j *Journal) Delete(fileName string) error {
+	return j.append(journalRecord{Op: opDelete, File: FilesInfo{FileName: fileName}})
+}
+
+func (j *Journal) append(record journalRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err = j.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	j.entries++
+	atomic.StoreInt32(&j.unsynced, 1)
+	j.errMu.Lock()
+	defer j.errMu.Unlock()
+	err, j.syncErr = j.syncErr, nil
+	return err
+}
+
+// syncLoop fsyncs the records written in every syncInterval at once, so
+// writing a record does not wait for the disk.
+func (j *Journal) syncLoop() {
+	defer j.synced.Done()
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-j.done:
+			return
+		case <-ticker.C:
+			if !atomic.CompareAndSwapInt32(&j.unsynced, 1, 0) {
+				continue
+			}
+			if err := j.file.Sync(); err != nil {
+				j.errMu.Lock()
+				j.syncErr = err
+				j.errMu.Unlock()
+			}
+		}
+	}
+}
+
+func (j *Journal) needSnapshot() bool {
+	return j.entries >= snapshotEvery
+}
+
+// Snapshot writes m to the snapshot file and truncates the journal.
+func (j *Journal) Snapshot(m map[string]FilesInfo) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err = utils.WriteFileAtomic(filepath.Join(j.dir, snapshotFileName), data, 0644); err != nil {
+		return err
+	}
+	if err = j.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err = j.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	j.entries = 0
+	atomic.StoreInt32(&j.unsynced, 0)
+	return j.file.Sync()
+}
+
+func (j *Journal) Close() error {
+	close(j.done)
+	j.synced.Wait()
+	return j.file.Close()
+}
+
+func loadSnapshot(dir string) (map[string]FilesInfo, error) {
+	m := map[string]FilesInfo{}
+	data, err := os.ReadFile(filepath.Join(dir, snapshotFileName))
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("corrupted snapshot %v: %v", snapshotFileName, err)
+	}
+	return m, nil
+}
+
+// replayJournal applies journal records to m. A record that cannot be decoded
+// is treated as the tail of an interrupted write: it and everything after it
+// are dropped. Returns the number of records applied.
+func replayJournal(dir string, m map[string]FilesInfo) (int, error) {
+	file, err := os.Open(filepath.Join(dir, journalFileName))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	applied := 0
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return applied, nil
+		}
+		if err != nil {
+			return applied, err
+		}
+		var record journalRecord
+		if json.Unmarshal(line, &record) != nil {
+			return applied, nil
+		}
+		switch record.Op {
+		case opPut:
+			m[record.File.FileName] = record.File
+		case opDelete:
+			delete(m, record.File.FileName)
+		}
+		applied++
+	}
+}
+
+// loadIndex reads the snapshot and replays the journal on top of it.
+func loadIndex(dir string) (map[string]FilesInfo, int, error) {
+	m, err := loadSnapshot(dir)
+	if err != nil {
+		return nil, 0, err
+	}
+	applied, err := replayJournal(dir, m)
+	if err != nil {
+		return nil, 0, err
+	}
+	return m, applied, nil
+}
+
+// recheckQueued marks the files that were still queued for copying as failed
+// and due for a retry, so the next scan checks them again: it copies those
+// still in the source and deletes the destination copies of those gone.
+func recheckQueued(m map[string]FilesInfo) map[string]FilesInfo {
+	for name, file := range m {
+		if file.Status == InSync {
+			file.Status = Failed
+			file.LastError = "copy was interrupted"
+			file.NextRetry = time.Time{}
+			m[name] = file
+		}
+	}
+	return m
+}
+
+func openJournal(dir string, m map[string]FilesInfo) (*Journal, error) {
+	file, err := os.OpenFile(filepath.Join(dir, journalFileName), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	j := &Journal{dir: dir, file: file, done: make(chan struct{})}
+	if err = j.Snapshot(m); err != nil {
+		file.Close()
+		return nil, err
+	}
+	j.synced.Add(1)
+	go j.syncLoop()
+	return j, nil
+}
@@ -1,6 +1,8 @@
 package storage
 
 import (
+	"context"
+	"fmt"
 	"sync"
 	"time"
 )
@@ -10,20 +12,75 @@ type Status int
 const (
 	InSync Status = iota
 	Sync
+	// Failed marks files that could not be hashed or copied, they are retried
+	// after NextRetry.
+	Failed
+	// Abandoned marks files that failed too many times. They are retried only
+	// by hand or when the source file changes.
+	Abandoned
 )
 
+var statusNames = map[Status]string{
+	InSync:    "queued",
+	Sync:      "synced",
+	Failed:    "failed",
+	Abandoned: "given up",
+}
+
+func (s Status) String() string {
+	if name, ok := statusNames[s]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// ParseStatus returns the Status with the name printed by String.
+func ParseStatus(name string) (Status, error) {
+	for status, statusName := range statusNames {
+		if statusName == name {
+			return status, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown status %q, supported: queued, synced, failed, given up", name)
+}
+
 type FilesInfo struct {
-	FileName     string
-	FilePath     string
-	Hash         string
+	// FileName is the path of the file relative to the source directory.
+	FileName string
+	FilePath string
+	Hash     string
+	// HashAlgo is the name of the algorithm Hash was computed with.
+	HashAlgo     string
 	LastModified time.Time
-	Status       Status
+	// Metadata is the fingerprint of preserved metadata, see utils.MetadataFingerprint.
+	Metadata  string
+	Status    Status
+	LastError string
+	// Attempts counts failed attempts to sync the file since it was last synced.
+	Attempts  int
+	NextRetry time.Time
+	// LinkTarget is set for symlinks copied as links.
+	LinkTarget string
+	// HardlinkOf is the FileName of the file this one is a hard link to.
+	HardlinkOf string
+	// DestHash and DestModified describe the destination copy as it was
+	// last synced by a two-way sync.
+	DestHash     string
+	DestModified time.Time
 }
 
 type Storage interface {
 	ChangeStatusToSync(fileName string, wg *sync.WaitGroup)
-	AddFileToSync(file FilesInfo, wg *sync.WaitGroup, fileToSync chan string)
-	IsFileChanged(path string, lastModified time.Time) (bool, string)
+	AddFileToSync(ctx context.Context, file FilesInfo, wg *sync.WaitGroup, fileToSync chan string) error
+	IsFileChanged(fileName, path string, lastModified time.Time) (bool, string, error)
 	GetFile(fileName string) (FilesInfo, bool)
+	PutFile(file FilesInfo)
+	Rename(oldName string, file FilesInfo)
+	Forget(fileName string)
+	MarkFailed(file FilesInfo, err error, nextRetry time.Time)
 	CheckIfExistAndRemove(dstDir string, wg *sync.WaitGroup) error
+	FindRemoved() []FilesInfo
+	Failed() []FilesInfo
+	Verify(dstDir string) []Drift
+	Len() int
 }
@@ -1,9 +1,15 @@
 package storage
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
 	"reflect"
 	"sync"
+	"sync_dir/internal/utils"
 	"testing"
 	"time"
 )
@@ -60,7 +66,9 @@ func TestFiles_AddFileToSync(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			f := NewFileStorage(tt.fields.m, logger)
 			tt.args.wg.Add(1)
-			f.AddFileToSync(tt.args.file, tt.args.wg, tt.args.filesToSync)
+			if err := f.AddFileToSync(context.Background(), tt.args.file, tt.args.wg, tt.args.filesToSync); err != nil {
+				t.Errorf("AddFileToSync() error = %v", err)
+			}
 		})
 	}
 }
@@ -94,6 +102,7 @@ func TestFiles_IsFileChanged(t *testing.T) {
 		m map[string]FilesInfo
 	}
 	type args struct {
+		fileName     string
 		path         string
 		lastModified time.Time
 	}
@@ -104,13 +113,13 @@ func TestFiles_IsFileChanged(t *testing.T) {
 		want   bool
 		want1  string
 	}{
-		{name: "simple test", want: false, want1: hash, fields: fields{m: map[string]FilesInfo{file.FileName: file}}, args: args{path: path, lastModified: time.Now()}},
+		{name: "simple test", want: false, want1: hash, fields: fields{m: map[string]FilesInfo{file.FileName: file}}, args: args{fileName: file.FileName, path: path, lastModified: time.Now()}},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			f := NewFileStorage(tt.fields.m, logger)
 
-			got, got1 := f.IsFileChanged(tt.args.path, tt.args.lastModified)
+			got, got1, _ := f.IsFileChanged(tt.args.fileName, tt.args.path, tt.args.lastModified)
 			if got != tt.want {
 				t.Errorf("IsFileChanged() got = %v, want %v", got, tt.want)
 			}
@@ -156,6 +165,11 @@ func TestFiles_GetFile(t *testing.T) {
 }
 
 func TestFiles_CheckIfExistAndRemove(t *testing.T) {
+	// A non-empty directory in place of the destination copy can't be removed.
+	busyDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(busyDir, fileNotExistSrc.FileName, "1.txt"), 0755); err != nil {
+		t.Fatal(err)
+	}
 	type fields struct {
 		m      map[string]FilesInfo
 		logger *logrus.Entry
@@ -170,7 +184,7 @@ func TestFiles_CheckIfExistAndRemove(t *testing.T) {
 		args    args
 		wantErr bool
 	}{
-		{name: "simple test", wantErr: true, fields: fields{map[string]FilesInfo{fileNotExistSrc.FileName: fileNotExistSrc}, logger}, args: args{dstDir: dstDir, wg: &sync.WaitGroup{}}},
+		{name: "remove fails", wantErr: true, fields: fields{map[string]FilesInfo{fileNotExistSrc.FileName: fileNotExistSrc}, logger}, args: args{dstDir: busyDir, wg: &sync.WaitGroup{}}},
 		{name: "not exist", wantErr: false, fields: fields{map[string]FilesInfo{fileNotExist.FileName: fileNotExist}, logger}, args: args{dstDir: dstDir, wg: &sync.WaitGroup{}}},
 	}
 	for _, tt := range tests {
@@ -186,3 +200,264 @@ func TestFiles_CheckIfExistAndRemove(t *testing.T) {
 		})
 	}
 }
+
+func TestNewPersistentStorage(t *testing.T) {
+	synced := FilesInfo{FileName: "1.txt", FilePath: path, Hash: hash, Status: Sync}
+	queued := FilesInfo{FileName: "2.txt", FilePath: pathNotExist, Hash: hash, Status: InSync}
+	tests := []struct {
+		name    string
+		journal string
+		want    map[string]bool
+		// wantFailed are the files marked failed to be checked again.
+		wantFailed []string
+	}{
+		{name: "empty index", want: map[string]bool{}},
+		{name: "replay journal", journal: journalLines(t, journalRecord{Op: opPut, File: synced}), want: map[string]bool{"1.txt": true}},
+		{
+			name:       "recheck queued files",
+			journal:    journalLines(t, journalRecord{Op: opPut, File: synced}, journalRecord{Op: opPut, File: queued}),
+			want:       map[string]bool{"1.txt": true, "2.txt": true},
+			wantFailed: []string{"2.txt"},
+		},
+		{name: "replay delete", journal: journalLines(t, journalRecord{Op: opPut, File: synced}, journalRecord{Op: opDelete, File: synced}), want: map[string]bool{"1.txt": false}},
+		{name: "torn last record", journal: journalLines(t, journalRecord{Op: opPut, File: synced}) + `{"op":"delete","fi`, want: map[string]bool{"1.txt": true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, journalFileName), []byte(tt.journal), 0644); err != nil {
+				t.Fatal(err)
+			}
+			f, err := NewPersistentStorage(dir, logger)
+			if err != nil {
+				t.Fatalf("NewPersistentStorage() error = %v", err)
+			}
+			for name, want := range tt.want {
+				if _, got := f.GetFile(name); got != want {
+					t.Errorf("GetFile(%v) got = %v, want %v", name, got, want)
+				}
+			}
+			for _, name := range tt.wantFailed {
+				if file, _ := f.GetFile(name); file.Status != Failed || !file.NextRetry.IsZero() {
+					t.Errorf("GetFile(%v) = %+v, want failed and due", name, file)
+				}
+			}
+			if err = f.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+			reopened, err := NewPersistentStorage(dir, logger)
+			if err != nil {
+				t.Fatalf("NewPersistentStorage() after Close error = %v", err)
+			}
+			defer reopened.Close()
+			if !reflect.DeepEqual(reopened.m, f.m) {
+				t.Errorf("reopened index = %v, want %v", reopened.m, f.m)
+			}
+		})
+	}
+}
+
+func TestReadFileStorage(t *testing.T) {
+	synced := FilesInfo{FileName: "1.txt", FilePath: path, Hash: hash, Status: Sync}
+	queued := FilesInfo{FileName: "2.txt", FilePath: pathNotExist, Hash: hash, Status: InSync}
+	tests := []struct {
+		name string
+		load func(string, *logrus.Entry) (*Files, error)
+		want map[string]Status
+	}{
+		{name: "read keeps queued files", load: ReadFileStorage, want: map[string]Status{"1.txt": Sync, "2.txt": InSync}},
+		{name: "load rechecks queued files", load: LoadFileStorage, want: map[string]Status{"1.txt": Sync, "2.txt": Failed}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			journal := journalLines(t, journalRecord{Op: opPut, File: synced}, journalRecord{Op: opPut, File: queued})
+			if err := os.WriteFile(filepath.Join(dir, journalFileName), []byte(journal), 0644); err != nil {
+				t.Fatal(err)
+			}
+			f, err := tt.load(dir, logger)
+			if err != nil {
+				t.Fatalf("load error = %v", err)
+			}
+			for name, want := range tt.want {
+				if file, ok := f.GetFile(name); !ok || file.Status != want {
+					t.Errorf("GetFile(%v) = %v, %v, want status %v", name, file, ok, want)
+				}
+			}
+		})
+	}
+}
+
+func journalLines(t *testing.T, records ...journalRecord) string {
+	var lines string
+	for _, record := range records {
+		data, err := json.Marshal(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines += string(data) + "\n"
+	}
+	return lines
+}
+
+func TestFiles_MigrateHashes(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	for _, dir := range []string{srcDir, dstDir} {
+		if err := os.WriteFile(filepath.Join(dir, "1.txt"), []byte("hello"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dstDir, "2.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := func(path string) time.Time {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.ModTime()
+	}
+	synced, destSynced := modTime(filepath.Join(srcDir, "1.txt")), modTime(filepath.Join(dstDir, "1.txt"))
+	sha256, err := utils.NewHasher("sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const (
+		md5Hash    = "5d41402abc4b2a76b9719d911017c592"
+		sha256Hash = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	)
+	tests := []struct {
+		name     string
+		file     FilesInfo
+		want     FilesInfo
+		wantKept bool
+	}{
+		{
+			name:     "legacy md5 entry",
+			file:     FilesInfo{FileName: "1.txt", Hash: md5Hash, LastModified: synced},
+			want:     FilesInfo{FileName: "1.txt", Hash: sha256Hash, HashAlgo: "sha256", LastModified: synced},
+			wantKept: true,
+		},
+		{
+			name:     "same algorithm",
+			file:     FilesInfo{FileName: "1.txt", Hash: "stale", HashAlgo: "sha256"},
+			want:     FilesInfo{FileName: "1.txt", Hash: "stale", HashAlgo: "sha256"},
+			wantKept: true,
+		},
+		{
+			name:     "two-way entry",
+			file:     FilesInfo{FileName: "1.txt", Hash: md5Hash, HashAlgo: "md5", LastModified: synced, DestHash: md5Hash, DestModified: destSynced},
+			want:     FilesInfo{FileName: "1.txt", Hash: sha256Hash, HashAlgo: "sha256", LastModified: synced, DestHash: sha256Hash, DestModified: destSynced},
+			wantKept: true,
+		},
+		{
+			name:     "source changed since sync",
+			file:     FilesInfo{FileName: "1.txt", Hash: md5Hash, HashAlgo: "md5", LastModified: synced.Add(-time.Minute)},
+			want:     FilesInfo{FileName: "1.txt", Hash: md5Hash, HashAlgo: "md5", LastModified: synced.Add(-time.Minute)},
+			wantKept: true,
+		},
+		{
+			name:     "destination changed since two-way sync",
+			file:     FilesInfo{FileName: "1.txt", Hash: md5Hash, HashAlgo: "md5", LastModified: synced, DestHash: md5Hash, DestModified: destSynced.Add(-time.Minute)},
+			want:     FilesInfo{FileName: "1.txt", Hash: md5Hash, HashAlgo: "md5", LastModified: synced, DestHash: md5Hash, DestModified: destSynced.Add(-time.Minute)},
+			wantKept: true,
+		},
+		{
+			name:     "source removed",
+			file:     FilesInfo{FileName: "2.txt", Hash: md5Hash, HashAlgo: "md5"},
+			want:     FilesInfo{FileName: "2.txt", Hash: md5Hash, HashAlgo: "md5"},
+			wantKept: true,
+		},
+		{
+			name: "missing destination copy",
+			file: FilesInfo{FileName: "3.txt", Hash: md5Hash, HashAlgo: "md5"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewFileStorage(map[string]FilesInfo{tt.file.FileName: tt.file}, logger).WithHasher(sha256)
+			f.MigrateHashes(srcDir, dstDir)
+			got, ok := f.GetFile(tt.file.FileName)
+			if ok != tt.wantKept {
+				t.Fatalf("GetFile() got1 = %v, want %v", ok, tt.wantKept)
+			}
+			if ok && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetFile() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFiles_Verify(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "1.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("1.txt", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	helloMD5 := "5d41402abc4b2a76b9719d911017c592"
+	tests := []struct {
+		name string
+		file FilesInfo
+		want DriftKind
+	}{
+		{name: "in sync", file: FilesInfo{FileName: "1.txt", Hash: helloMD5, HashAlgo: "md5", Status: Sync}},
+		{name: "legacy entry", file: FilesInfo{FileName: "1.txt", Hash: helloMD5, Status: Sync}},
+		{name: "modified", file: FilesInfo{FileName: "1.txt", Hash: hash, HashAlgo: "md5", Status: Sync}, want: Modified},
+		{name: "missing", file: FilesInfo{FileName: "2.txt", Hash: helloMD5, Status: Sync}, want: Missing},
+		{name: "not synced yet", file: FilesInfo{FileName: "2.txt", Hash: helloMD5, Status: InSync}},
+		{name: "symlink", file: FilesInfo{FileName: "link", LinkTarget: "1.txt", Status: Sync}},
+		{name: "symlink retargeted", file: FilesInfo{FileName: "link", LinkTarget: "2.txt", Status: Sync}, want: Modified},
+		{name: "unknown algorithm", file: FilesInfo{FileName: "1.txt", Hash: helloMD5, HashAlgo: "crc", Status: Sync}, want: Unreadable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewFileStorage(map[string]FilesInfo{tt.file.FileName: tt.file}, logger)
+			drifts := f.Verify(dir)
+			if tt.want == "" && len(drifts) != 0 || tt.want != "" && (len(drifts) != 1 || drifts[0].Kind != tt.want) {
+				t.Errorf("Verify() = %+v, want %v", drifts, tt.want)
+			}
+		})
+	}
+}
+
+func TestFiles_MarkFailed(t *testing.T) {
+	retryAt := time.Now().Add(time.Minute)
+	tests := []struct {
+		name       string
+		nextRetry  time.Time
+		wantStatus Status
+	}{
+		{name: "retry later", nextRetry: retryAt, wantStatus: Failed},
+		{name: "give up", wantStatus: Abandoned},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewFileStorage(map[string]FilesInfo{}, logger)
+			f.MarkFailed(FilesInfo{FileName: "1.txt", Attempts: 2}, errors.New("disk full"), tt.nextRetry)
+			got, _ := f.GetFile("1.txt")
+			if got.Status != tt.wantStatus || got.LastError != "disk full" || !got.NextRetry.Equal(tt.nextRetry) {
+				t.Errorf("GetFile() = %+v, want status %v", got, tt.wantStatus)
+			}
+			if failed := f.Failed(); len(failed) != 1 {
+				t.Errorf("Failed() = %v, want 1.txt", failed)
+			}
+			if reset := f.ResetFailed("2.txt"); reset != 0 {
+				t.Errorf("ResetFailed(2.txt) = %v, want 0", reset)
+			}
+			if reset := f.ResetFailed("1.txt"); reset != 1 {
+				t.Errorf("ResetFailed(1.txt) = %v, want 1", reset)
+			}
+			if got, _ = f.GetFile("1.txt"); got.Status != Failed || got.Attempts != 0 || !got.NextRetry.IsZero() {
+				t.Errorf("GetFile() after reset = %+v", got)
+			}
+			wg := &sync.WaitGroup{}
+			wg.Add(1)
+			f.ChangeStatusToSync("1.txt", wg)
+			if got, _ = f.GetFile("1.txt"); got.Status != Sync || got.LastError != "" || len(f.Failed()) != 0 {
+				t.Errorf("GetFile() after sync = %+v", got)
+			}
+		})
+	}
+}
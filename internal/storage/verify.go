@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"sync_dir/internal/utils"
+)
+
+type DriftKind string
+
+const (
+	// Missing means the destination copy does not exist.
+	Missing DriftKind = "missing"
+	// Modified means the destination copy differs from the indexed hash or link target.
+	Modified DriftKind = "modified"
+	// Unreadable means the destination copy could not be checked.
+	Unreadable DriftKind = "unreadable"
+	// Extra means the destination file is neither in the index nor in the source.
+	Extra DriftKind = "extra"
+)
+
+// Drift describes a destination file that no longer matches the index.
+type Drift struct {
+	FileName string
+	Kind     DriftKind
+	Err      string
+	Repaired bool
+}
+
+// Verify re-hashes the destination copies of synced files with the
+// algorithm each of them was indexed with and returns those that differ.
+func (f *Files) Verify(dstDir string) []Drift {
+	var drifts []Drift
+	for _, file := range f.List() {
+		if file.Status != Sync {
+			continue
+		}
+		if kind, err := verifyFile(filepath.Join(dstDir, file.FileName), file); kind != "" {
+			drift := Drift{FileName: file.FileName, Kind: kind}
+			if err != nil {
+				drift.Err = err.Error()
+			}
+			drifts = append(drifts, drift)
+		}
+	}
+	return drifts
+}
+
+func verifyFile(dst string, file FilesInfo) (DriftKind, error) {
+	info, err := os.Lstat(dst)
+	if os.IsNotExist(err) {
+		return Missing, nil
+	}
+	if err != nil {
+		return Unreadable, err
+	}
+	if file.LinkTarget != "" {
+		target, err := os.Readlink(dst)
+		if err != nil {
+			return Modified, err
+		}
+		if target != file.LinkTarget {
+			return Modified, nil
+		}
+		return "", nil
+	}
+	if !info.Mode().IsRegular() {
+		return Modified, nil
+	}
+	algo := file.HashAlgo
+	if algo == "" {
+		algo = utils.DefaultHashAlgo
+	}
+	hasher, err := utils.NewHasher(algo)
+	if err != nil {
+		return Unreadable, err
+	}
+	hash, err := hasher.Sum(dst)
+	if err != nil {
+		return Unreadable, err
+	}
+	if hash != file.Hash {
+		return Modified, nil
+	}
+	return "", nil
+}
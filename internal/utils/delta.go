@@ -0,0 +1,291 @@
+package utils
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+)
+
+const (
+	DefaultCopyStrategy = "full"
+	// DeltaMinSize is the size below which destination files are copied
+	// whole, a delta saves little on them.
+	DeltaMinSize = 1 << 20
+
+	minBlockSize = 4 << 10
+	maxBlockSize = 128 << 10
+)
+
+// clone is cloneFile, replaced in tests on file systems without reflinks.
+var clone = cloneFile
+
+// errNoClone means the destination file could not be cloned, so a delta copy
+// would not save any writes.
+var errNoClone = errors.New("file cloning is not supported")
+
+// CopyFunc copies the file src to dst with the metadata selected by p and
+// tells how much it wrote.
+type CopyFunc func(src, dst string, p Preserve) (CopyStats, error)
+
+var copiers = map[string]CopyFunc{
+	"full":  CopyFull,
+	"delta": CopyDelta,
+}
+
+func NewCopier(name string) (CopyFunc, error) {
+	c, ok := copiers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown copy strategy %q, supported: %v", name, CopyStrategies())
+	}
+	return c, nil
+}
+
+func CopyStrategies() []string {
+	names := make([]string, 0, len(copiers))
+	for name := range copiers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CopyStats tells how much of a file a copy wrote and how much a delta copy
+// took from the old destination file.
+type CopyStats struct {
+	// Matched is the number of bytes found in the old destination file.
+	Matched int64
+	// Written is the number of bytes written to the new file. Only blocks
+	// left in place in the cloned destination file are not written.
+	Written int64
+}
+
+// CopyFull copies src to dst whole with CopyFilesWithOsRW.
+func CopyFull(src, dst string, p Preserve) (CopyStats, error) {
+	sourceFileStat, err := os.Stat(src)
+	if err != nil {
+		return CopyStats{}, err
+	}
+	if err = CopyFilesWithOsRW(src, dst, p); err != nil {
+		return CopyStats{}, err
+	}
+	return CopyStats{Written: sourceFileStat.Size()}, nil
+}
+
+// CopyDelta copies src over an existing dst like rsync does: blocks of src
+// found in dst by their rolling and strong checksums are taken from dst, the
+// rest is read from src. The new file is written through a temporary file
+// that is a clone of dst, then only the changed ranges are written. Small or
+// missing destination files, and files on file systems without reflinks,
+// where a delta would cost more reads than it saves writes, are copied whole
+// with CopyFull.
+func CopyDelta(src, dst string, p Preserve) (CopyStats, error) {
+	sourceFileStat, err := os.Stat(src)
+	if err != nil {
+		return CopyStats{}, err
+	}
+	if !sourceFileStat.Mode().IsRegular() {
+		return CopyStats{}, fmt.Errorf("%s is not a regular file", src)
+	}
+	destFileStat, err := os.Stat(dst)
+	if err != nil || !destFileStat.Mode().IsRegular() || destFileStat.Size() < DeltaMinSize {
+		return CopyFull(src, dst, p)
+	}
+	source, err := os.Open(src)
+	if err != nil {
+		return CopyStats{}, err
+	}
+	defer source.Close()
+	old, err := os.Open(dst)
+	if err != nil {
+		return CopyStats{}, err
+	}
+	defer old.Close()
+	var stats CopyStats
+	err = writeAtomic(dst, copyPerm(sourceFileStat, p), func(tmp *os.File) error {
+		if err := clone(tmp, old); err != nil {
+			return fmt.Errorf("%w: %v", errNoClone, err)
+		}
+		sig, err := newSignature(old, blockSize(destFileStat.Size()))
+		if err != nil {
+			return err
+		}
+		w := &deltaWriter{out: tmp, old: old, buf: make([]byte, sig.blockSize)}
+		if err = w.match(source, sig); err != nil {
+			return err
+		}
+		stats = w.stats
+		return tmp.Truncate(w.offset)
+	}, metadataOf(src, p))
+	if errors.Is(err, errNoClone) {
+		return CopyFull(src, dst, p)
+	}
+	return stats, err
+}
+
+// blockSize is about the square root of the file size, a power of two so
+// that blocks left in place stay aligned to file system blocks.
+func blockSize(size int64) int {
+	bs := minBlockSize
+	for bs < maxBlockSize && int64(bs)*int64(bs) < size {
+		bs *= 2
+	}
+	return bs
+}
+
+type block struct {
+	offset int64
+	strong [md5.Size]byte
+}
+
+// signature holds the checksums of the full blocks of a file by their
+// rolling checksum.
+type signature struct {
+	blockSize int
+	blocks    map[uint32][]block
+}
+
+func newSignature(r io.Reader, blockSize int) (*signature, error) {
+	sig := &signature{blockSize: blockSize, blocks: map[uint32][]block{}}
+	buf := make([]byte, blockSize)
+	for offset := int64(0); ; offset += int64(blockSize) {
+		if _, err := io.ReadFull(r, buf); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sig, nil
+		} else if err != nil {
+			return nil, err
+		}
+		a, b := weakSum(buf)
+		weak := a | b<<16
+		sig.blocks[weak] = append(sig.blocks[weak], block{offset: offset, strong: md5.Sum(buf)})
+	}
+}
+
+// find returns the block with the contents of window, preferring the one at
+// offset, so that it does not have to be moved.
+func (s *signature) find(weak uint32, window []byte, offset int64) (block, bool) {
+	candidates, ok := s.blocks[weak]
+	if !ok {
+		return block{}, false
+	}
+	strong := md5.Sum(window)
+	found, ok := block{}, false
+	for _, candidate := range candidates {
+		if candidate.strong != strong {
+			continue
+		}
+		if candidate.offset == offset {
+			return candidate, true
+		}
+		if !ok {
+			found, ok = candidate, true
+		}
+	}
+	return found, ok
+}
+
+// weakSum is the rsync rolling checksum of p.
+func weakSum(p []byte) (uint32, uint32) {
+	var a, b uint32
+	for i, x := range p {
+		a += uint32(x)
+		b += uint32(len(p)-i) * uint32(x)
+	}
+	return a & math.MaxUint16, b & math.MaxUint16
+}
+
+// deltaWriter writes the new file from literal data and blocks of the old
+// one over a clone of the old one.
+type deltaWriter struct {
+	out    *os.File
+	old    *os.File
+	offset int64
+	stats  CopyStats
+	buf    []byte
+}
+
+// match reads src and writes it out, taking the blocks found in sig from the
+// old file.
+func (w *deltaWriter) match(src io.Reader, sig *signature) error {
+	bs := sig.blockSize
+	data := make([]byte, 0, 4*bs)
+	lit, pos := 0, 0
+	var a, b uint32
+	rolling, eof := false, false
+	for {
+		if pos+bs > len(data) {
+			if eof {
+				break
+			}
+			if pos-lit >= bs {
+				if err := w.literal(data[lit:pos]); err != nil {
+					return err
+				}
+				lit = pos
+			}
+			data = data[:copy(data, data[lit:])]
+			pos -= lit
+			lit = 0
+			n, err := io.ReadFull(src, data[len(data):cap(data)])
+			data = data[:len(data)+n]
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+			continue
+		}
+		window := data[pos : pos+bs]
+		if !rolling {
+			a, b = weakSum(window)
+			rolling = true
+		}
+		if found, ok := sig.find(a|b<<16, window, w.offset+int64(pos-lit)); ok {
+			if err := w.literal(data[lit:pos]); err != nil {
+				return err
+			}
+			if err := w.block(found, bs); err != nil {
+				return err
+			}
+			pos += bs
+			lit = pos
+			rolling = false
+			continue
+		}
+		pos++
+		if pos+bs > len(data) {
+			rolling = false
+			continue
+		}
+		out, in := uint32(data[pos-1]), uint32(data[pos+bs-1])
+		a = (a - out + in) & math.MaxUint16
+		b = (b - uint32(bs)*out + a) & math.MaxUint16
+	}
+	return w.literal(data[lit:])
+}
+
+func (w *deltaWriter) literal(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if _, err := w.out.WriteAt(data, w.offset); err != nil {
+		return err
+	}
+	w.offset += int64(len(data))
+	w.stats.Written += int64(len(data))
+	return nil
+}
+
+func (w *deltaWriter) block(found block, size int) error {
+	w.stats.Matched += int64(size)
+	if found.offset == w.offset {
+		w.offset += int64(size)
+		return nil
+	}
+	if _, err := w.old.ReadAt(w.buf[:size], found.offset); err != nil {
+		return err
+	}
+	return w.literal(w.buf[:size])
+}
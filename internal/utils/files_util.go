@@ -1,28 +1,27 @@
 package utils
 
 import (
-	"crypto/md5"
 	"fmt"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
-func FileMD5(path string) string {
-	h := md5.New()
-	f, err := os.Open(path)
-	if err != nil {
-		panic(err)
-	}
-	defer f.Close()
-	_, err = io.Copy(h, f)
-	if err != nil {
-		panic(err)
-	}
-	return fmt.Sprintf("%x", h.Sum(nil))
+const (
+	tempMarker      = ".sync-tmp-"
+	defaultFileMode = 0644
+)
+
+func FileMD5(path string) (string, error) {
+	return hashers["md5"].Sum(path)
 }
 
-func CopyFilesWithIoCopy(src, dst string) error {
+// CopyFilesWithIoCopy copies src to dst. Like the other copy functions it
+// applies the metadata selected by p to the new file before it replaces dst.
+func CopyFilesWithIoCopy(src, dst string, p Preserve) error {
 	sourceFileStat, err := os.Stat(src)
 	if err != nil {
 		return err
@@ -35,16 +34,13 @@ func CopyFilesWithIoCopy(src, dst string) error {
 		return err
 	}
 	defer source.Close()
-	destination, err := os.Create(dst)
-	if err != nil {
+	return writeAtomic(dst, copyPerm(sourceFileStat, p), func(destination *os.File) error {
+		_, err := io.Copy(destination, source)
 		return err
-	}
-	defer destination.Close()
-	_, err = io.Copy(destination, source)
-	return err
+	}, metadataOf(src, p))
 }
 
-func CopyFilesWithIoutil(src, dst string) error {
+func CopyFilesWithIoutil(src, dst string, p Preserve) error {
 	sourceFileStat, err := os.Stat(src)
 	if err != nil {
 		return err
@@ -55,7 +51,10 @@ func CopyFilesWithIoutil(src, dst string) error {
 		return err
 	}
 
-	err = ioutil.WriteFile(dst, input, sourceFileStat.Mode())
+	err = writeAtomic(dst, copyPerm(sourceFileStat, p), func(file *os.File) error {
+		_, err := file.Write(input)
+		return err
+	}, metadataOf(src, p))
 	if err != nil {
 		fmt.Println("Error creating", dst)
 		fmt.Println(err)
@@ -64,7 +63,7 @@ func CopyFilesWithIoutil(src, dst string) error {
 	return nil
 }
 
-func CopyFilesWithOsRW(src, dst string) error {
+func CopyFilesWithOsRW(src, dst string, p Preserve) error {
 	sourceFileStat, err := os.Stat(src)
 	if err != nil {
 		return err
@@ -80,28 +79,109 @@ func CopyFilesWithOsRW(src, dst string) error {
 	}
 	defer source.Close()
 
-	destination, err := os.Create(dst)
+	return writeAtomic(dst, copyPerm(sourceFileStat, p), func(destination *os.File) error {
+		buf := make([]byte, 1000)
+		for {
+			n, err := source.Read(buf)
+			if err != nil && err != io.EOF {
+				return err
+			}
+			if n == 0 {
+				break
+			}
+
+			if _, err := destination.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, metadataOf(src, p))
+}
+
+func WriteFileAtomic(path string, data []byte, perm fs.FileMode) error {
+	return writeAtomic(path, perm, func(file *os.File) error {
+		_, err := file.Write(data)
+		return err
+	}, nil)
+}
+
+// copyPerm is the permissions a copy of a file is written with, so it is
+// never more open than the source while its metadata is applied.
+func copyPerm(info fs.FileInfo, p Preserve) fs.FileMode {
+	if p.Mode {
+		return info.Mode().Perm()
+	}
+	return defaultFileMode
+}
+
+// metadataOf returns a function applying the metadata of src selected by p
+// to a file.
+func metadataOf(src string, p Preserve) func(string) error {
+	return func(path string) error {
+		return CopyMetadata(src, path, p)
+	}
+}
+
+// writeAtomic writes dst through a temporary file in the same directory that
+// is fsynced and renamed over dst, so readers never see a partial file.
+// finish, if set, is called with the temporary file before the rename, so
+// dst never has the new content without its metadata.
+func writeAtomic(dst string, perm fs.FileMode, write func(*os.File) error, finish func(string) error) error {
+	dir, base := filepath.Split(dst)
+	tmp, err := os.CreateTemp(dir, "."+base+tempMarker+"*")
+	if err != nil {
+		return err
+	}
+	err = tmp.Chmod(perm.Perm())
+	if err == nil {
+		err = write(tmp)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && finish != nil {
+		err = finish(tmp.Name())
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), dst)
+	}
 	if err != nil {
+		os.Remove(tmp.Name())
 		return err
 	}
-	defer destination.Close()
+	return SyncDir(filepath.Dir(dst))
+}
 
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	buf := make([]byte, 1000)
-	for {
-		n, err := source.Read(buf)
-		if err != nil && err != io.EOF {
-			return err
-		}
-		if n == 0 {
-			break
-		}
+	defer d.Close()
+	return d.Sync()
+}
 
-		if _, err := destination.Write(buf[:n]); err != nil {
+func IsTempFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.Contains(name, tempMarker)
+}
+
+// RemoveTempFiles removes temporary files left in dir by interrupted copies.
+func RemoveTempFiles(dir string) (int, error) {
+	removed := 0
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
 			return err
 		}
-	}
-	return nil
+		if !entry.IsDir() && IsTempFile(entry.Name()) {
+			if err = os.Remove(path); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	return removed, err
 }
@@ -1,8 +1,14 @@
 package utils
 
 import (
+	"bytes"
+	"errors"
 	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 const (
@@ -12,7 +18,7 @@ const (
 
 func BenchmarkCopyFilesWithIoCopy(b *testing.B) {
 	for i := 0; i < b.N; i++ {
-		err := CopyFilesWithIoCopy(src, dst)
+		err := CopyFilesWithIoCopy(src, dst, Preserve{})
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -21,7 +27,7 @@ func BenchmarkCopyFilesWithIoCopy(b *testing.B) {
 
 func BenchmarkCopyFilesWithIoutil(b *testing.B) {
 	for i := 0; i < b.N; i++ {
-		err := CopyFilesWithIoutil(src, dst)
+		err := CopyFilesWithIoutil(src, dst, Preserve{})
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -30,9 +36,339 @@ func BenchmarkCopyFilesWithIoutil(b *testing.B) {
 
 func BenchmarkCopyFilesWithOsRW(b *testing.B) {
 	for i := 0; i < b.N; i++ {
-		err := CopyFilesWithOsRW(src, dst)
+		err := CopyFilesWithOsRW(src, dst, Preserve{})
 		if err != nil {
 			log.Fatal(err)
 		}
 	}
 }
+
+func BenchmarkCopyDelta(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		_, err := CopyDelta(src, dst, Preserve{})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func TestNewHasher(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "1.txt")
+	if err := os.WriteFile(path, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{name: "md5", want: "5d41402abc4b2a76b9719d911017c592"},
+		{name: "sha256", want: "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"},
+		{name: "blake2b", want: "324dcf027dd4a30a932c441f365a25e86b173defa4b8e58948253471b81b72cf"},
+		{name: "xxhash", want: "26c7827d889f6da3"},
+		{name: "crc32", wantErr: true},
+	}
+	if _, err := DefaultHasher().Sum(filepath.Join(filepath.Dir(path), "2.txt")); err == nil {
+		t.Errorf("Sum() of missing file error = nil")
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := NewHasher(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewHasher() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got, err := h.Sum(path); err != nil || got != tt.want {
+				t.Errorf("Sum() = %v, %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCopyFilesWithOsRW(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.txt")
+	if err := os.WriteFile(src, []byte("new content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	private := filepath.Join(dir, "private.txt")
+	if err := os.WriteFile(private, []byte("new content"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		src      string
+		dst      string
+		preserve Preserve
+		wantMode os.FileMode
+		wantErr  bool
+	}{
+		{name: "new file", src: src, dst: filepath.Join(dir, "1.txt"), wantMode: 0644},
+		{name: "overwrite", src: src, dst: filepath.Join(dir, "1.txt"), wantMode: 0644},
+		{name: "private file", src: private, dst: filepath.Join(dir, "4.txt"), preserve: Preserve{Mode: true}, wantMode: 0600},
+		{name: "missing source", src: filepath.Join(dir, "missing.txt"), dst: filepath.Join(dir, "2.txt"), wantErr: true},
+		{name: "missing destination dir", src: src, dst: filepath.Join(dir, "a", "3.txt"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := CopyFilesWithOsRW(tt.src, tt.dst, tt.preserve); (err != nil) != tt.wantErr {
+				t.Fatalf("CopyFilesWithOsRW() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr {
+				if got, err := os.ReadFile(tt.dst); err != nil || string(got) != "new content" {
+					t.Errorf("destination = %q, %v", got, err)
+				}
+				info, err := os.Stat(tt.dst)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if info.Mode().Perm() != tt.wantMode {
+					t.Errorf("destination mode = %v, want %v", info.Mode().Perm(), tt.wantMode)
+				}
+			}
+			if removed, err := RemoveTempFiles(dir); err != nil || removed != 0 {
+				t.Errorf("temporary files left: %v, %v", removed, err)
+			}
+		})
+	}
+}
+
+func TestCreateTemp(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "1.txt")
+	tests := []struct {
+		name    string
+		exists  int
+		err     error
+		wantErr bool
+	}{
+		{name: "free name", exists: 0},
+		{name: "taken names", exists: 3},
+		{name: "other error", err: os.ErrPermission, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tries := 0
+			_, err := createTemp(dst, func(tmp string) error {
+				tries++
+				if tries <= tt.exists {
+					return os.ErrExist
+				}
+				return tt.err
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("createTemp() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && tries != tt.exists+1 {
+				t.Errorf("createTemp() tried %v names, want %v", tries, tt.exists+1)
+			}
+		})
+	}
+}
+
+func TestRemoveTempFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]bool{
+		"1.txt":                          false,
+		".1.txt" + tempMarker + "123":    true,
+		"a/.2.txt" + tempMarker + "456":  true,
+		"a/2.txt":                        false,
+		"a/report" + tempMarker + ".txt": false,
+	}
+	for name := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	removed, err := RemoveTempFiles(dir)
+	if err != nil || removed != 2 {
+		t.Fatalf("RemoveTempFiles() = %v, %v, want 2", removed, err)
+	}
+	for name, wantRemoved := range files {
+		if _, err := os.Stat(filepath.Join(dir, name)); os.IsNotExist(err) != wantRemoved {
+			t.Errorf("%v removed = %v, want %v", name, os.IsNotExist(err), wantRemoved)
+		}
+	}
+}
+
+func TestParsePreserve(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    Preserve
+		wantErr bool
+	}{
+		{value: "", want: Preserve{}},
+		{value: "mode,times", want: Preserve{Mode: true, Times: true}},
+		{value: "mode, times, owner, xattr", want: Preserve{Mode: true, Times: true, Owner: true, Xattr: true}},
+		{value: "acl", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := ParsePreserve(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParsePreserve() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParsePreserve() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCopyMetadata(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src.sh"), filepath.Join(dir, "dst.sh")
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name      string
+		preserve  Preserve
+		wantMode  os.FileMode
+		wantMtime bool
+	}{
+		{name: "nothing", wantMode: 0644},
+		{name: "mode", preserve: Preserve{Mode: true}, wantMode: 0755},
+		{name: "mode and times", preserve: Preserve{Mode: true, Times: true}, wantMode: 0755, wantMtime: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, path := range []string{src, dst} {
+				os.Remove(path)
+				if err := os.WriteFile(path, []byte("#!/bin/sh"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.Chmod(src, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(src, mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+			if err := CopyMetadata(src, dst, tt.preserve); err != nil {
+				t.Fatalf("CopyMetadata() error = %v", err)
+			}
+			info, err := os.Stat(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != tt.wantMode {
+				t.Errorf("mode = %v, want %v", info.Mode().Perm(), tt.wantMode)
+			}
+			if info.ModTime().Equal(mtime) != tt.wantMtime {
+				t.Errorf("mtime = %v, preserved %v", info.ModTime(), tt.wantMtime)
+			}
+			srcInfo, _ := os.Stat(src)
+			srcMeta, _ := MetadataFingerprint(src, srcInfo, tt.preserve)
+			dstMeta, _ := MetadataFingerprint(dst, info, tt.preserve)
+			if srcMeta != dstMeta {
+				t.Errorf("MetadataFingerprint() = %v, want %v", dstMeta, srcMeta)
+			}
+		})
+	}
+}
+
+func TestCopyDelta(t *testing.T) {
+	dir := t.TempDir()
+	old := make([]byte, 4*DeltaMinSize)
+	rand.New(rand.NewSource(1)).Read(old)
+	changed := append([]byte{}, old...)
+	copy(changed[DeltaMinSize:], "changed block")
+	inserted := append([]byte("inserted"), old...)
+	tests := []struct {
+		name        string
+		old         []byte
+		new         []byte
+		wantMatched int64
+	}{
+		{name: "missing destination", new: old},
+		{name: "small destination", old: old[:DeltaMinSize-1], new: old},
+		{name: "same file", old: old, new: old, wantMatched: int64(len(old))},
+		{name: "changed block", old: old, new: changed, wantMatched: int64(len(old) - blockSize(int64(len(old))))},
+		{name: "inserted at start", old: old, new: inserted, wantMatched: int64(len(old))},
+		{name: "truncated", old: old, new: old[:len(old)/2+100], wantMatched: int64(len(old) / 2)},
+		{name: "appended", old: old, new: append(append([]byte{}, old...), "appended"...), wantMatched: int64(len(old))},
+	}
+	// Where the file system has no reflinks, the reflinks case copies the
+	// destination file instead of cloning it.
+	fileSystems := []struct {
+		name  string
+		clone func(dst, src *os.File) error
+		delta bool
+	}{
+		{
+			name: "reflinks",
+			clone: func(dst, src *os.File) error {
+				if cloneFile(dst, src) == nil {
+					return nil
+				}
+				data, err := os.ReadFile(src.Name())
+				if err == nil {
+					_, err = dst.WriteAt(data, 0)
+				}
+				return err
+			},
+			delta: true,
+		},
+		{
+			name:  "no reflinks",
+			clone: func(dst, src *os.File) error { return errors.New("not supported") },
+		},
+	}
+	defer func() { clone = cloneFile }()
+	for _, fs := range fileSystems {
+		clone = fs.clone
+		for _, tt := range tests {
+			t.Run(fs.name+"/"+tt.name, func(t *testing.T) {
+				src := filepath.Join(dir, "src.img")
+				dst := filepath.Join(dir, "dst.img")
+				os.Remove(dst)
+				if err := os.WriteFile(src, tt.new, 0644); err != nil {
+					t.Fatal(err)
+				}
+				if tt.old != nil {
+					if err := os.WriteFile(dst, tt.old, 0644); err != nil {
+						t.Fatal(err)
+					}
+				}
+				wantMatched := tt.wantMatched
+				if !fs.delta {
+					wantMatched = 0
+				}
+				stats, err := CopyDelta(src, dst, Preserve{})
+				if err != nil {
+					t.Fatalf("CopyDelta() error = %v", err)
+				}
+				if stats.Matched != wantMatched {
+					t.Errorf("CopyDelta() matched %v bytes, want %v", stats.Matched, wantMatched)
+				}
+				if stats.Written > int64(len(tt.new)) || wantMatched == 0 && stats.Written != int64(len(tt.new)) {
+					t.Errorf("CopyDelta() wrote %v bytes of %v", stats.Written, len(tt.new))
+				}
+				if got, err := os.ReadFile(dst); err != nil || !bytes.Equal(got, tt.new) {
+					t.Errorf("destination differs from the source, error %v", err)
+				}
+				if removed, err := RemoveTempFiles(dir); err != nil || removed != 0 {
+					t.Errorf("temporary files left: %v, %v", removed, err)
+				}
+			})
+		}
+	}
+	if _, err := CopyDelta(filepath.Join(dir, "missing.img"), filepath.Join(dir, "dst.img"), Preserve{}); err == nil {
+		t.Errorf("CopyDelta() of missing file error = nil")
+	}
+}
+
+func TestNewCopier(t *testing.T) {
+	for _, name := range CopyStrategies() {
+		if c, err := NewCopier(name); err != nil || c == nil {
+			t.Errorf("NewCopier(%q) = %v", name, err)
+		}
+	}
+	if _, err := NewCopier("rsync"); err == nil {
+		t.Errorf("NewCopier() of unknown strategy error = nil")
+	}
+}
@@ -0,0 +1,74 @@
+package utils
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"github.com/cespare/xxhash/v2"
+	"golang.org/x/crypto/blake2b"
+	"hash"
+	"io"
+	"os"
+	"sort"
+)
+
+const DefaultHashAlgo = "md5"
+
+type Hasher interface {
+	Name() string
+	Sum(path string) (string, error)
+}
+
+type fileHasher struct {
+	name    string
+	newHash func() hash.Hash
+}
+
+func (h fileHasher) Name() string {
+	return h.name
+}
+
+func (h fileHasher) Sum(path string) (string, error) {
+	sum := h.newHash()
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	_, err = io.Copy(sum, f)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sum.Sum(nil)), nil
+}
+
+var hashers = map[string]Hasher{
+	"md5":    fileHasher{name: "md5", newHash: md5.New},
+	"sha256": fileHasher{name: "sha256", newHash: sha256.New},
+	"blake2b": fileHasher{name: "blake2b", newHash: func() hash.Hash {
+		h, _ := blake2b.New256(nil)
+		return h
+	}},
+	"xxhash": fileHasher{name: "xxhash", newHash: func() hash.Hash { return xxhash.New() }},
+}
+
+func NewHasher(name string) (Hasher, error) {
+	h, ok := hashers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown hash algorithm %q, supported: %v", name, HashAlgos())
+	}
+	return h, nil
+}
+
+func DefaultHasher() Hasher {
+	return hashers[DefaultHashAlgo]
+}
+
+func HashAlgos() []string {
+	names := make([]string, 0, len(hashers))
+	for name := range hashers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+)
+
+// FileID identifies a file on a device, files with the same FileID are
+// hard links to each other.
+type FileID struct {
+	Dev uint64
+	Ino uint64
+}
+
+// HardlinkID returns the FileID of a file that has more than one link.
+func HardlinkID(info fs.FileInfo) (FileID, bool) {
+	return hardlinkID(info)
+}
+
+func SameFile(a, b string) bool {
+	aInfo, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bInfo, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(aInfo, bInfo)
+}
+
+// CopySymlink creates dst as a symlink with the same target as src,
+// replacing whatever dst was.
+func CopySymlink(src, dst string) error {
+	target, err := os.Readlink(src)
+	if err != nil {
+		return err
+	}
+	if current, err := os.Readlink(dst); err == nil && current == target {
+		return nil
+	}
+	tmp, err := createTemp(dst, func(tmp string) error {
+		return os.Symlink(target, tmp)
+	})
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return SyncDir(filepath.Dir(dst))
+}
+
+// LinkFile makes dst a hard link to existing, replacing whatever dst was.
+func LinkFile(existing, dst string) error {
+	if SameFile(existing, dst) {
+		return nil
+	}
+	tmp, err := createTemp(dst, func(tmp string) error {
+		return os.Link(existing, tmp)
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return SyncDir(filepath.Dir(dst))
+}
+
+// createTemp calls create with temporary names next to dst until one does
+// not exist yet, like os.CreateTemp, and returns the name used.
+func createTemp(dst string, create func(tmp string) error) (string, error) {
+	for try := 0; ; try++ {
+		tmp := tempName(dst)
+		err := create(tmp)
+		if os.IsExist(err) && try < 10000 {
+			continue
+		}
+		return tmp, err
+	}
+}
+
+func tempName(dst string) string {
+	dir, base := filepath.Split(dst)
+	return filepath.Join(dir, fmt.Sprintf(".%s%s%d", base, tempMarker, rand.Int63()))
+}
@@ -0,0 +1,110 @@
+package utils
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const modeBits = fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky
+
+// Preserve selects which file metadata is copied to the destination.
+type Preserve struct {
+	Mode  bool
+	Times bool
+	Owner bool
+	Xattr bool
+}
+
+func ParsePreserve(value string) (Preserve, error) {
+	var p Preserve
+	for _, name := range strings.Split(value, ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+		case "mode":
+			p.Mode = true
+		case "times":
+			p.Times = true
+		case "owner":
+			p.Owner = true
+		case "xattr":
+			p.Xattr = true
+		default:
+			return p, fmt.Errorf("unknown metadata %q, supported: mode, times, owner, xattr", name)
+		}
+	}
+	return p, nil
+}
+
+func (p Preserve) Any() bool {
+	return p.Mode || p.Times || p.Owner || p.Xattr
+}
+
+// CopyMetadata applies the selected metadata of src to dst. Ownership is
+// changed only when the process runs as root.
+func CopyMetadata(src, dst string, p Preserve) error {
+	if !p.Any() {
+		return nil
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if p.Xattr {
+		if err = copyXattrs(src, dst); err != nil {
+			return err
+		}
+	}
+	if p.Owner && os.Geteuid() == 0 {
+		if uid, gid, ok := fileOwner(info); ok {
+			if err = os.Lchown(dst, uid, gid); err != nil {
+				return err
+			}
+		}
+	}
+	if p.Mode {
+		if err = os.Chmod(dst, info.Mode()&modeBits); err != nil {
+			return err
+		}
+	}
+	if p.Times {
+		return os.Chtimes(dst, fileAccessTime(info), info.ModTime())
+	}
+	return nil
+}
+
+// MetadataFingerprint describes the selected metadata of a file, so a change
+// of it can be noticed without comparing the file with its copy. Access time
+// is not part of it, since it changes on every read.
+func MetadataFingerprint(path string, info fs.FileInfo, p Preserve) (string, error) {
+	var parts []string
+	if p.Mode {
+		parts = append(parts, fmt.Sprintf("mode=%o", info.Mode()&modeBits))
+	}
+	if p.Times {
+		parts = append(parts, "mtime="+info.ModTime().UTC().Format(time.RFC3339Nano))
+	}
+	if p.Owner {
+		if uid, gid, ok := fileOwner(info); ok {
+			parts = append(parts, fmt.Sprintf("owner=%d:%d", uid, gid))
+		}
+	}
+	if p.Xattr {
+		attrs, err := readXattrs(path)
+		if err != nil {
+			return "", err
+		}
+		names := make([]string, 0, len(attrs))
+		for name := range attrs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			parts = append(parts, fmt.Sprintf("xattr.%s=%x", name, attrs[name]))
+		}
+	}
+	return strings.Join(parts, " "), nil
+}
@@ -0,0 +1,93 @@
+//go:build linux
+
+package utils
+
+import (
+	"errors"
+	"golang.org/x/sys/unix"
+	"io/fs"
+	"strings"
+	"syscall"
+	"time"
+)
+
+func fileOwner(info fs.FileInfo) (int, int, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(stat.Uid), int(stat.Gid), true
+}
+
+func fileAccessTime(info fs.FileInfo) time.Time {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return info.ModTime()
+	}
+	return time.Unix(stat.Atim.Sec, stat.Atim.Nsec)
+}
+
+func readXattrs(path string) (map[string][]byte, error) {
+	attrs := map[string][]byte{}
+	size, err := unix.Llistxattr(path, nil)
+	if errors.Is(err, unix.ENOTSUP) {
+		return attrs, nil
+	}
+	if err != nil || size == 0 {
+		return attrs, err
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(path, buf); err != nil {
+		return nil, err
+	}
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		valueSize, err := unix.Lgetxattr(path, name, nil)
+		if errors.Is(err, unix.ENODATA) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, valueSize)
+		if valueSize, err = unix.Lgetxattr(path, name, value); err != nil {
+			return nil, err
+		}
+		attrs[name] = value[:valueSize]
+	}
+	return attrs, nil
+}
+
+// copyXattrs sets the extended attributes of src on dst and removes the
+// ones src does not have.
+func copyXattrs(src, dst string) error {
+	attrs, err := readXattrs(src)
+	if err != nil {
+		return err
+	}
+	for name, value := range attrs {
+		if err = unix.Lsetxattr(dst, name, value, 0); err != nil && !errors.Is(err, unix.ENOTSUP) {
+			return err
+		}
+	}
+	current, err := readXattrs(dst)
+	if err != nil {
+		return err
+	}
+	for name := range current {
+		if _, ok := attrs[name]; ok {
+			continue
+		}
+		if err = unix.Lremovexattr(dst, name); err != nil && !errors.Is(err, unix.ENODATA) && !errors.Is(err, unix.ENOTSUP) {
+			return err
+		}
+	}
+	return nil
+}
+
+func hardlinkID(info fs.FileInfo) (FileID, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || stat.Nlink < 2 {
+		return FileID{}, false
+	}
+	return FileID{Dev: uint64(stat.Dev), Ino: stat.Ino}, true
+}
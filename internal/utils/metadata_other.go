@@ -0,0 +1,28 @@
+//go:build !linux
+
+package utils
+
+import (
+	"io/fs"
+	"time"
+)
+
+func fileOwner(info fs.FileInfo) (int, int, bool) {
+	return 0, 0, false
+}
+
+func fileAccessTime(info fs.FileInfo) time.Time {
+	return info.ModTime()
+}
+
+func readXattrs(path string) (map[string][]byte, error) {
+	return map[string][]byte{}, nil
+}
+
+func copyXattrs(src, dst string) error {
+	return nil
+}
+
+func hardlinkID(info fs.FileInfo) (FileID, bool) {
+	return FileID{}, false
+}
@@ -0,0 +1,265 @@
+package versions
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync_dir/internal/utils"
+	"time"
+)
+
+// DirName is the directory in the destination root previous versions are
+// kept in, under the same relative paths as the files themselves.
+const DirName = ".versions"
+
+// timeLayout is the suffix of a version name after a ~. It sorts in time
+// order and has no characters some file systems refuse.
+const timeLayout = "20060102T150405.000000000Z"
+
+// Policy tells which versions of a file are kept. A version is removed as
+// soon as one of the rules drops it, the zero Policy keeps everything.
+type Policy struct {
+	// KeepLast is how many of the newest versions left by the other rules are
+	// kept, 0 for all of them.
+	KeepLast int
+	// KeepFor is how long versions are kept, 0 for forever.
+	KeepFor time.Duration
+	// Staggered keeps every version for an hour, then one per hour for a
+	// day, one per day for a month and one per week after that.
+	Staggered bool
+}
+
+type Version struct {
+	// FileName is the path of the file relative to the destination directory.
+	FileName string
+	// Path is where the version is stored.
+	Path string
+	// Time is when the version was replaced or deleted.
+	Time time.Time
+	Size int64
+}
+
+// Store keeps previous versions of destination files.
+type Store struct {
+	destDir string
+	policy  Policy
+	now     func() time.Time
+}
+
+func NewStore(destDir string, policy Policy) *Store {
+	return &Store{destDir: destDir, policy: policy, now: time.Now}
+}
+
+func (s *Store) root() string {
+	return filepath.Join(s.destDir, DirName)
+}
+
+func (s *Store) path(fileName string, t time.Time) string {
+	return filepath.Join(s.root(), fileName+"~"+t.UTC().Format(timeLayout))
+}
+
+// Save keeps a copy of the destination file before it is overwritten. The
+// copy is a hard link where possible, as the file is replaced by a rename
+// and the old content stays untouched. Missing files and anything but
+// regular files are not versioned.
+func (s *Store) Save(fileName string) error {
+	dst := filepath.Join(s.destDir, fileName)
+	info, err := os.Lstat(dst)
+	if os.IsNotExist(err) || err == nil && !info.Mode().IsRegular() {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	version := s.path(fileName, s.now())
+	if err = os.MkdirAll(filepath.Dir(version), 0755); err != nil {
+		return err
+	}
+	if err = os.Link(dst, version); err != nil {
+		if err = utils.CopyFilesWithIoCopy(dst, version, utils.Preserve{Mode: true}); err != nil {
+			return fmt.Errorf("error saving version of %v: %v", fileName, err)
+		}
+	}
+	_, err = s.Prune(fileName)
+	return err
+}
+
+// Remove moves the destination file into the versions instead of deleting
+// it. Anything but regular files is deleted.
+func (s *Store) Remove(fileName string) error {
+	dst := filepath.Join(s.destDir, fileName)
+	info, err := os.Lstat(dst)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return os.Remove(dst)
+	}
+	version := s.path(fileName, s.now())
+	if err = os.MkdirAll(filepath.Dir(version), 0755); err != nil {
+		return err
+	}
+	if err = os.Rename(dst, version); err != nil {
+		return err
+	}
+	_, err = s.Prune(fileName)
+	return err
+}
+
+// List returns the versions of fileName, the newest first.
+func (s *Store) List(fileName string) ([]Version, error) {
+	dir := filepath.Join(s.root(), filepath.Dir(fileName))
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var versions []Version
+	for _, entry := range entries {
+		version, ok := s.parse(filepath.Join(dir, entry.Name()), entry)
+		if ok && version.FileName == filepath.Clean(fileName) {
+			versions = append(versions, version)
+		}
+	}
+	sortNewest(versions)
+	return versions, nil
+}
+
+// All returns the versions of all files, the newest first.
+func (s *Store) All() ([]Version, error) {
+	var versions []Version
+	err := filepath.WalkDir(s.root(), func(path string, entry fs.DirEntry, err error) error {
+		if os.IsNotExist(err) && path == s.root() {
+			return fs.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if version, ok := s.parse(path, entry); ok {
+			versions = append(versions, version)
+		}
+		return nil
+	})
+	sortNewest(versions)
+	return versions, err
+}
+
+func (s *Store) parse(path string, entry fs.DirEntry) (Version, bool) {
+	if entry.IsDir() || utils.IsTempFile(entry.Name()) {
+		return Version{}, false
+	}
+	i := strings.LastIndex(path, "~")
+	if i < 0 {
+		return Version{}, false
+	}
+	t, err := time.Parse(timeLayout, path[i+1:])
+	if err != nil {
+		return Version{}, false
+	}
+	fileName, err := filepath.Rel(s.root(), path[:i])
+	if err != nil {
+		return Version{}, false
+	}
+	version := Version{FileName: fileName, Path: path, Time: t}
+	if info, err := entry.Info(); err == nil {
+		version.Size = info.Size()
+	}
+	return version, true
+}
+
+func sortNewest(versions []Version) {
+	sort.SliceStable(versions, func(i, j int) bool {
+		return versions[i].Time.After(versions[j].Time)
+	})
+}
+
+// Prune removes the versions of fileName the policy does not keep and
+// returns how many were removed.
+func (s *Store) Prune(fileName string) (int, error) {
+	versions, err := s.List(fileName)
+	if err != nil {
+		return 0, err
+	}
+	return s.prune(versions)
+}
+
+// PruneAll applies the policy to the versions of all files, so versions
+// that only got too old are removed as well.
+func (s *Store) PruneAll() (int, error) {
+	versions, err := s.All()
+	if err != nil {
+		return 0, err
+	}
+	byFile := map[string][]Version{}
+	for _, version := range versions {
+		byFile[version.FileName] = append(byFile[version.FileName], version)
+	}
+	pruned := 0
+	for _, fileVersions := range byFile {
+		n, err := s.prune(fileVersions)
+		pruned += n
+		if err != nil {
+			return pruned, err
+		}
+	}
+	return pruned, nil
+}
+
+// prune removes versions of a single file, given the newest first.
+func (s *Store) prune(versions []Version) (int, error) {
+	now := s.now()
+	buckets := map[string]bool{}
+	pruned, kept := 0, 0
+	for _, version := range versions {
+		age := now.Sub(version.Time)
+		keep := s.policy.KeepFor <= 0 || age <= s.policy.KeepFor
+		if s.policy.Staggered {
+			if bucket, ok := staggeredBucket(version.Time, age); ok {
+				keep = keep && !buckets[bucket]
+				buckets[bucket] = true
+			}
+		}
+		if keep && (s.policy.KeepLast <= 0 || kept < s.policy.KeepLast) {
+			kept++
+			continue
+		}
+		if err := os.Remove(version.Path); err != nil && !os.IsNotExist(err) {
+			return pruned, err
+		}
+		s.removeEmptyParents(filepath.Dir(version.Path))
+		pruned++
+	}
+	return pruned, nil
+}
+
+func (s *Store) removeEmptyParents(dir string) {
+	for dir != s.root() && strings.HasPrefix(dir, s.root()) {
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// staggeredBucket names the interval a version of the given age shares with
+// others, only one version per bucket is kept. Versions younger than an
+// hour are all kept.
+func staggeredBucket(t time.Time, age time.Duration) (string, bool) {
+	const day = 24 * time.Hour
+	t = t.UTC()
+	switch {
+	case age < time.Hour:
+		return "", false
+	case age < day:
+		return "h" + t.Truncate(time.Hour).Format(time.RFC3339), true
+	case age < 30*day:
+		return "d" + t.Format("2006-01-02"), true
+	}
+	year, week := t.ISOWeek()
+	return fmt.Sprintf("w%v-%v", year, week), true
+}
@@ -0,0 +1,108 @@
+package versions
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStore_SaveRemove(t *testing.T) {
+	destDir := t.TempDir()
+	dst := filepath.Join(destDir, "a", "b.txt")
+	writeFile(t, dst, "v1")
+	store := NewStore(destDir, Policy{})
+	now := time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC)
+	store.now = func() time.Time { return now }
+	if err := store.Save("a/b.txt"); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	// The destination is replaced by a rename, as the copy does.
+	writeFile(t, dst+".new", "v2")
+	if err := os.Rename(dst+".new", dst); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Minute)
+	if err := store.Remove("a/b.txt"); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	if _, err := os.Lstat(dst); !os.IsNotExist(err) {
+		t.Errorf("Remove() left %v, error = %v", dst, err)
+	}
+	if err := store.Save("missing.txt"); err != nil {
+		t.Errorf("Save() of a missing file error = %v", err)
+	}
+	versions, err := store.List("a/b.txt")
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	want := []string{"v2", "v1"}
+	if len(versions) != len(want) {
+		t.Fatalf("List() = %v, want %v versions", versions, len(want))
+	}
+	for i, version := range versions {
+		content, err := os.ReadFile(version.Path)
+		if err != nil || string(content) != want[i] {
+			t.Errorf("version %v = %q, %v, want %q", version.Time, content, err, want[i])
+		}
+		if version.FileName != filepath.Join("a", "b.txt") {
+			t.Errorf("version FileName = %v", version.FileName)
+		}
+	}
+}
+
+func TestStore_Prune(t *testing.T) {
+	now := time.Date(2026, 10, 18, 10, 30, 0, 0, time.UTC)
+	ages := []time.Duration{
+		10 * time.Minute,
+		50 * time.Minute,
+		2 * time.Hour,
+		2*time.Hour + 10*time.Minute,
+		3 * time.Hour,
+		3 * 24 * time.Hour,
+		3*24*time.Hour + time.Hour,
+		60 * 24 * time.Hour,
+		61 * 24 * time.Hour,
+	}
+	tests := []struct {
+		name   string
+		policy Policy
+		want   int
+	}{
+		{name: "keep all", policy: Policy{}, want: 9},
+		{name: "keep last", policy: Policy{KeepLast: 3}, want: 3},
+		{name: "keep for", policy: Policy{KeepFor: 24 * time.Hour}, want: 5},
+		{name: "staggered", policy: Policy{Staggered: true}, want: 6},
+		{name: "staggered and keep last", policy: Policy{Staggered: true, KeepLast: 4}, want: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			destDir := t.TempDir()
+			store := NewStore(destDir, tt.policy)
+			store.now = func() time.Time { return now }
+			for _, age := range ages {
+				writeFile(t, store.path("f.txt", now.Add(-age)), "old")
+			}
+			if _, err := store.PruneAll(); err != nil {
+				t.Fatalf("PruneAll() error = %v", err)
+			}
+			versions, err := store.List("f.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(versions) != tt.want {
+				t.Errorf("kept %v versions, want %v", len(versions), tt.want)
+			}
+		})
+	}
+}
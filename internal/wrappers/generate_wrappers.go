@@ -2,3 +2,5 @@ package wrappers
 
 //go:generate gowrap gen -p ../scanner -i FileScanner -t logrus -o ../scanner/generated_scanner/scanner_with_log.go
 //go:generate gowrap gen -p ../storage -i Storage -t logrus -o ../storage/generated_storage/storage_with_log.go
+//go:generate gowrap gen -g -p ../scanner -i FileScanner -t templates/metrics -o ../metrics/scanner_with_metrics.go
+//go:generate gowrap gen -g -p ../storage -i Storage -t templates/metrics -o ../metrics/storage_with_metrics.go